@@ -12,9 +12,9 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/Masterminds/squirrel"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
 	_ "github.com/lib/pq"
@@ -24,6 +24,7 @@ import (
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
+	"github.com/danielgtaylor/huma/v2/sse"
 )
 
 type RefreshTokenStore struct {
@@ -45,30 +46,84 @@ const secondViewAggregate = "ten_second_sum"
 const minuteViewAggregate = "minute_sum"
 const hourlyViewAggregate = "hourly_sum"
 const dailyViewAggregate = "daily_sum"
+const weeklyViewAggregate = "weekly_sum"
+const monthlyViewAggregate = "monthly_sum"
+const yearlyViewAggregate = "yearly_sum"
 const averageDailyViewAggregate = "avg_daily_sum"
 const averageHourlyViewAggregate = "avg_hourly_sum"
 
+// whether nl is live, and the stream session counts belong to. it's read from the
+// chat, category and cooccurrence goroutines.
 type LiveStatus struct {
-	IsLive bool
+	// going live and offline write to the db, and don't overlap
+	transition sync.Mutex
+	mu         sync.RWMutex
+	isLive     bool
+	streamID   uint
 }
 
-type SpanQuery struct {
-	Span TimeRange `query:"span" default:"9 hours" enum:"30 minutes,1 hour,9 hours,1 week,1 month,1 year,all"`
+func (ls *LiveStatus) current() (bool, uint) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+
+	return ls.isLive, ls.streamID
+}
+
+func (ls *LiveStatus) set(isLive bool, streamID uint) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	ls.isLive, ls.streamID = isLive, streamID
 }
 
-func (ls *LiveStatus) setLiveStatus(liveStatusUpdate bool, db *gorm.DB) {
-	if !ls.IsLive && liveStatusUpdate {
+func (ls *LiveStatus) setLiveStatus(liveStatusUpdate bool, db *gorm.DB, tokenManager *TokenManager) {
+	ls.transition.Lock()
+	defer ls.transition.Unlock()
+
+	isLive, _ := ls.current()
+
+	if !isLive && liveStatusUpdate {
 		// pog!
-		ls.IsLive = true
+		session, err := startStreamSession(db, tokenManager)
+
+		if err != nil {
+			// still offline, so the next batch of counts tries again
+			fmt.Println("error starting stream session", err)
+			return
+		}
+
+		ls.set(true, session.ID)
 		return
 	}
 
-	if ls.IsLive && !liveStatusUpdate {
-		// nl has logged off, refresh our aggregates to get the latest stream data
-		tomorrow := time.Now().AddDate(0, 0, 1).Format("2006-01-02")
-		yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	if isLive && !liveStatusUpdate {
+		endedSession, err := endStreamSession(db, tokenManager)
+
+		if err != nil {
+			fmt.Println("error ending stream session", err)
+		}
+
+		ls.set(false, 0)
 
-		aggregates := []string{secondViewAggregate, minuteViewAggregate, hourlyViewAggregate, dailyViewAggregate, averageDailyViewAggregate, averageHourlyViewAggregate}
+		// nl has logged off, refresh our aggregates to get the latest stream data
+		// day buckets start at the channel's midnight, so the window does too
+		today := channelDay(time.Now().In(channelLocation()))
+		tomorrow := today.AddDate(0, 0, 1).Format(time.RFC3339)
+		yesterday := today.AddDate(0, 0, -1).Format(time.RFC3339)
+
+		aggregates := []string{secondViewAggregate, minuteViewAggregate, hourlyViewAggregate, dailyViewAggregate}
+
+		// a refresh only touches buckets that fit entirely inside its window, so the
+		// weekly and longer aggregates look back a whole bucket and run to the latest data
+		longAggregateLookback := map[string]time.Time{
+			averageDailyViewAggregate:  time.Now().AddDate(0, 0, -8),
+			averageHourlyViewAggregate: time.Now().AddDate(0, 0, -8),
+			statsDailyViewAggregate:    time.Now().AddDate(0, 0, -8),
+			statsHourlyViewAggregate:   time.Now().AddDate(0, 0, -8),
+			weeklyViewAggregate:        time.Now().AddDate(0, 0, -8),
+			monthlyViewAggregate:       time.Now().AddDate(0, -1, -1),
+			yearlyViewAggregate:        time.Now().AddDate(-1, 0, -1),
+		}
 
 		for _, agg := range aggregates {
 			query := fmt.Sprintf("CALL refresh_continuous_aggregate('%s', '%s', '%s')", agg, yesterday, tomorrow)
@@ -80,23 +135,45 @@ func (ls *LiveStatus) setLiveStatus(liveStatusUpdate bool, db *gorm.DB) {
 			}
 		}
 
-		ls.IsLive = false
+		// monthly reads daily and yearly reads monthly, so they refresh in that order
+		for _, agg := range []string{averageDailyViewAggregate, averageHourlyViewAggregate, statsDailyViewAggregate, statsHourlyViewAggregate, weeklyViewAggregate, monthlyViewAggregate, yearlyViewAggregate} {
+			query := fmt.Sprintf("CALL refresh_continuous_aggregate('%s', '%s', NULL)", agg, longAggregateLookback[agg].Format("2006-01-02"))
+			err := db.Exec(query).Error
+
+			if err != nil {
+				fmt.Println("error refreshing aggregate ", agg)
+				continue
+			}
+		}
+
 		fmt.Println("succesfully refreshed aggregates")
 
-		err := refreshTopClipsCache(db)
+		// the refresh only rewrites buckets holding new counts, the stream's, and
+		// otherwise the refresh window's. a cached response depends on data up to the end
+		// of its last bucket, so one that read a year bucket goes too.
+		changedSince := today.AddDate(0, 0, -1)
+		if endedSession != nil {
+			changedSince = endedSession.StartedAt
+		}
+		responses.invalidateSince(changedSince)
+
+		err = refreshTopClipsCache(db)
 
 		if err != nil {
 			fmt.Println("error refreshing top clips store", err)
-			return
+		}
+
+		if endedSession != nil {
+			err = persistStreamReport(endedSession.ID, db)
+
+			if err != nil {
+				fmt.Println("error building stream report", err)
+			}
 		}
 
 	}
 }
 
-// live scroller for emotes, via websocket client-sidep
-// add small peak chart to show the spike
-// :)
-
 func main() {
 
 	env := GetConfig()
@@ -115,6 +192,106 @@ func main() {
 			})
 			fmt.Printf("#%02x%02x%02x", color.Red, color.Green, color.Blue)
 
+			return
+		case "backfill_streams":
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			err = db.AutoMigrate(&StreamSession{})
+
+			if err != nil {
+				fmt.Println("error migrating stream sessions", err)
+				return
+			}
+
+			err = backfillStreamSessions(db)
+
+			if err != nil {
+				fmt.Println("error backfilling stream sessions", err)
+			}
+
+			return
+		case "export":
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			err = runExport(db, os.Args[2:])
+
+			if err != nil {
+				fmt.Println("error exporting", err)
+				os.Exit(1)
+			}
+
+			return
+		case "create_admin_key", "revoke_admin_key":
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			err = db.AutoMigrate(&AdminKey{}, &AuditLog{})
+
+			if err != nil {
+				fmt.Println("error migrating admin keys", err)
+				return
+			}
+
+			name := ""
+			if len(os.Args) > 2 {
+				name = os.Args[2]
+			}
+
+			if os.Args[1] == "revoke_admin_key" {
+				err = revokeAdminKey(db, name)
+
+				if err != nil {
+					fmt.Println("error revoking admin key", err)
+					os.Exit(1)
+				}
+
+				return
+			}
+
+			key, err := createAdminKey(db, name)
+
+			if err != nil {
+				fmt.Println("error creating admin key", err)
+				os.Exit(1)
+			}
+
+			// the only time the key is shown, we keep just its hash
+			fmt.Println(key)
+
+			return
+		case "rebucket_days":
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			err = rebucketDayAggregates(db)
+
+			if err != nil {
+				fmt.Println("error rebucketing day aggregates", err)
+			}
+
+			return
+		case "rebuild_stream_reports":
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			err = rebuildStreamReports(db)
+
+			if err != nil {
+				fmt.Println("error rebuilding stream reports", err)
+			}
+
 			return
 		}
 	}
@@ -124,22 +301,47 @@ func main() {
 		return
 	}
 
-	liveStatus := &LiveStatus{IsLive: false}
+	err = migrateTables(db)
+
+	if err != nil {
+		fmt.Println("error migrating tables", err)
+		return
+	}
+
+	err = closeStaleStreamSessions(db)
+
+	if err != nil {
+		fmt.Println("error closing stale stream sessions", err)
+	}
+
+	liveStatus := &LiveStatus{}
 	tokenManager := getTokenManager(db)
+	liveBroadcaster := newLiveBroadcaster()
 
 	go doRegularBackup()
 
+	go validateTopClipsRegularly(db, tokenManager)
+
+	go pollChannelCategory(db, tokenManager, liveStatus)
+
 	go connectToTwitchChat(
 		tokenManager,
 		db,
 		liveStatus,
+		liveBroadcaster,
 	)
 
 	router := chi.NewMux()
 
-	router.Use(cors.Default().Handler)
+	// cors.Default, plus the headers the app reads
+	router.Use(cors.New(cors.Options{
+		ExposedHeaders: []string{nextCursorHeader, "X-Channel-Timezone"},
+	}).Handler)
+	router.Use(responses.middleware)
+
+	api := humachi.New(router, apiConfig("NL chat dashboard API", "1.0.0"))
 
-	api := humachi.New(router, huma.DefaultConfig("NL chat dashboard API", "1.0.0"))
+	api.UseMiddleware(adminAuth(api, db))
 
 	type ThumbnailInput struct {
 		ClipID string `query:"clip_id"`
@@ -167,7 +369,7 @@ func main() {
 		return &struct{ Body TwitchClip }{Body: *clip}, nil
 	})
 
-	huma.Get(api, "/api/initialize_top_clips", func(ctx context.Context, input *struct{}) (*struct{ Body bool }, error) {
+	registerAdmin(api, http.MethodGet, "/api/initialize_top_clips", func(ctx context.Context, input *struct{}) (*struct{ Body bool }, error) {
 		err := initializeTopClips(db)
 
 		if err != nil {
@@ -177,11 +379,11 @@ func main() {
 		return &struct{ Body bool }{Body: true}, nil
 	})
 
-	huma.Get(api, "/api/hero_all_time_clips", func(ctx context.Context, input *SpanQuery) (*AllTimeClipsOutput, error) {
-		return heroTopClips(input, db)
+	huma.Get(api, "/api/hero_all_time_clips", func(ctx context.Context, input *AllTimeClipsInput) (*AllTimeClipsOutput, error) {
+		return heroTopClips(*input, db)
 	})
 
-	huma.Put(api, "/api/refresh_top_clips_store", func(ctx context.Context, input *struct{}) (*struct{ Body bool }, error) {
+	registerAdmin(api, http.MethodPut, "/api/refresh_top_clips_store", func(ctx context.Context, input *struct{}) (*struct{ Body bool }, error) {
 		err := refreshTopClipsCache(db)
 		if err != nil {
 			fmt.Println("error refreshing top clips store", err)
@@ -190,6 +392,10 @@ func main() {
 		return &struct{ Body bool }{Body: true}, nil
 	})
 
+	huma.Get(api, "/api/dead_clips_report", func(ctx context.Context, input *struct{}) (*DeadClipReportOutput, error) {
+		return selectDeadClipReport(db)
+	})
+
 	huma.Get(api, "/api/clip_counts", func(ctx context.Context, input *ClipCountsInput) (*ClipCountsOutput, error) {
 		return selectClipsFromEmotePeaks(*input, db)
 	})
@@ -219,8 +425,22 @@ func main() {
 		return selectNearestClip(*input, db)
 	})
 
+	huma.Get(api, "/api/spikes", func(ctx context.Context, input *SpikesInput) (*SpikesOutput, error) {
+		return selectSpikes(*input, db)
+	})
+
+	sse.Register(api, huma.Operation{
+		OperationID: "live",
+		Method:      http.MethodGet,
+		Path:        "/api/live",
+		Summary:     "Live counts, top emotes and spikes as server-sent events",
+	}, liveEventTypes, func(ctx context.Context, input *struct{}, send sse.Sender) {
+		streamLiveEvents(ctx, liveBroadcaster, send)
+	})
+
 	huma.Get(api, "/api/is_live", func(ctx context.Context, input *struct{}) (*struct{ Body bool }, error) {
-		return &struct{ Body bool }{liveStatus.IsLive}, nil
+		isLive, _ := liveStatus.current()
+		return &struct{ Body bool }{isLive}, nil
 	})
 
 	huma.Get(api, "/api/emote_growth", func(ctx context.Context, input *EmotePerformanceInput) (*TopPerformingEmotesOutput, error) {
@@ -235,94 +455,101 @@ func main() {
 		return selectSums(db, *input)
 	})
 
-	huma.Get(api, "/api/latest_emote_sums", func(ctx context.Context, input *LatestEmoteSumInput) (*EmoteSumOutput, error) {
-		return selectLatestSums(*input, db)
+	huma.Get(api, "/api/emote_correlations", func(ctx context.Context, input *EmoteCorrelationInput) (*EmoteCorrelationOutput, error) {
+		return selectEmoteCorrelations(*input, db)
 	})
 
-	type PreviousStreamDateInput struct {
-		From time.Time `query:"from"`
-	}
-
-	// todo: eventually we should just include all data for a date in a single query
-	// reduce some round trips
-	huma.Get(api, "/api/previous_stream_date", func(ctx context.Context, input *PreviousStreamDateInput) (*struct{ Body time.Time }, error) {
-		psql := statementBuilder()
-		var query squirrel.SelectBuilder
-		if input.From.IsZero() {
-			query = psql.
-				Select("DATE(MAX(created_at))").
-				From("emote_counts").
-				Where(psql.
-					Select("DATE(max(created_at))").
-					From("emote_counts").
-					Prefix("created_at < (").
-					Suffix(")"))
-
-		} else {
-			query = psql.
-				Select("DATE(max(created_at))").
-				From("emote_counts").
-				Where(squirrel.Lt{"created_at": input.From})
-		}
+	huma.Get(api, "/api/cooccurrence", func(ctx context.Context, input *CooccurrenceInput) (*CooccurrenceOutput, error) {
+		return selectCooccurrence(*input, db)
+	})
 
-		var date time.Time
+	huma.Get(api, "/api/category_emotes", func(ctx context.Context, input *CategoryEmotesInput) (*CategoryEmotesOutput, error) {
+		return selectCategoryEmotes(*input, db)
+	})
 
-		queryString, args, _ := query.ToSql()
+	huma.Get(api, "/api/latest_emote_sums", func(ctx context.Context, input *LatestEmoteSumInput) (*EmoteSumOutput, error) {
+		return selectLatestSums(*input, db)
+	})
 
-		err := db.Raw(queryString, args...).Scan(&date).Error
+	huma.Get(api, "/api/previous_stream_date", func(ctx context.Context, input *PreviousStreamDateInput) (*StreamDateOutput, error) {
+		date, err := previousStreamDate(db, input.From)
 
 		if err != nil {
 			return nil, err
 		}
 
-		return &struct{ Body time.Time }{Body: date}, nil
-
+		return &StreamDateOutput{Timezone: channelTimezone(), Body: date}, nil
 	})
 
-	huma.Get(api, "/api/next_stream_date", func(ctx context.Context, input *PreviousStreamDateInput) (*struct{ Body time.Time }, error) {
+	huma.Get(api, "/api/next_stream_date", func(ctx context.Context, input *PreviousStreamDateInput) (*StreamDateOutput, error) {
 
 		if input.From.IsZero() {
 			return nil, fmt.Errorf("from date is required")
 		}
 
-		query := statementBuilder().
-			Select("DATE(min(created_at))").
-			From("emote_counts").
-			Where(squirrel.Gt{"created_at": input.From.Add(time.Hour * 24)})
-
-		var date time.Time
-
-		queryString, args, _ := query.ToSql()
-
-		err := db.Raw(queryString, args...).Scan(&date).Error
+		date, err := nextStreamDate(db, input.From)
 
 		if err != nil {
 			return nil, err
 		}
 
-		return &struct{ Body time.Time }{Body: date}, nil
+		return &StreamDateOutput{Timezone: channelTimezone(), Body: date}, nil
 	})
 
-	type EmoteOutput struct {
-		Body []Emote
-	}
+	huma.Get(api, "/api/day", func(ctx context.Context, input *DayInput) (*DayOutput, error) {
+		return selectDay(ctx, *input, db)
+	})
 
-	huma.Get(api, "/api/emotes", func(ctx context.Context, input *struct{}) (*EmoteOutput, error) {
-		trackedEmotes, err := getEmotesInDB(db)
+	huma.Get(api, "/api/export", func(ctx context.Context, input *ExportInput) (*huma.StreamResponse, error) {
+		return selectExport(*input, db)
+	})
 
-		emotes := make([]Emote, 0, len(trackedEmotes))
+	huma.Get(api, "/api/streams", func(ctx context.Context, input *StreamsInput) (*StreamsOutput, error) {
+		return selectStreams(*input, db)
+	})
 
-		for _, emote := range trackedEmotes {
-			emotes = append(emotes, emote)
-		}
+	huma.Get(api, "/api/streams/{id}", func(ctx context.Context, input *StreamInput) (*StreamOutput, error) {
+		return selectStream(*input, db)
+	})
 
-		if err != nil {
-			fmt.Println("Error getting emotes:", err)
-			return nil, err
-		}
+	huma.Get(api, "/api/compare", func(ctx context.Context, input *CompareInput) (*CompareOutput, error) {
+		return selectCompare(*input, db)
+	})
+
+	huma.Get(api, "/api/average_stream_curve", func(ctx context.Context, input *StreamCurveInput) (*StreamCurveOutput, error) {
+		return selectAverageStreamCurve(*input, db)
+	})
+
+	huma.Get(api, "/api/streams/{id}/report", func(ctx context.Context, input *StreamInput) (*StreamReportOutput, error) {
+		return selectStreamReport(*input, db)
+	})
 
-		return &EmoteOutput{Body: emotes}, nil
+	huma.Get(api, "/api/trackers", func(ctx context.Context, input *struct{}) (*TrackersOutput, error) {
+		return selectTrackers(db)
+	})
+
+	registerAdmin(api, http.MethodPost, "/api/trackers", func(ctx context.Context, input *TrackerInput) (*TrackerOutput, error) {
+		return createTracker(input, db)
+	})
+
+	registerAdmin(api, http.MethodDelete, "/api/trackers/{id}", func(ctx context.Context, input *DeleteTrackerInput) (*struct{}, error) {
+		return deleteTracker(input, db)
+	})
 
+	huma.Get(api, "/api/composites", func(ctx context.Context, input *struct{}) (*CompositesOutput, error) {
+		return selectComposites(db)
+	})
+
+	registerAdmin(api, http.MethodPost, "/api/composites", func(ctx context.Context, input *CompositeInput) (*CompositeOutput, error) {
+		return createComposite(input, db)
+	})
+
+	registerAdmin(api, http.MethodDelete, "/api/composites/{id}", func(ctx context.Context, input *DeleteCompositeInput) (*struct{}, error) {
+		return deleteComposite(input, db)
+	})
+
+	huma.Get(api, "/api/emotes", func(ctx context.Context, input *EmotesInput) (*EmoteOutput, error) {
+		return selectEmotes(*input, db)
 	})
 
 	port := fmt.Sprintf(":%s", os.Getenv("PORT"))
@@ -383,7 +610,7 @@ func (t *TokenManager) RefreshToken(db *gorm.DB) error {
 	return nil
 }
 
-func connectToTwitchChat(tokenManager *TokenManager, db *gorm.DB, liveStatus *LiveStatus) {
+func connectToTwitchChat(tokenManager *TokenManager, db *gorm.DB, liveStatus *LiveStatus, liveBroadcaster *LiveBroadcaster) {
 	env := GetConfig()
 
 	for {
@@ -417,7 +644,7 @@ func connectToTwitchChat(tokenManager *TokenManager, db *gorm.DB, liveStatus *Li
 
 		go syncTrackingEmotes(db, latestEmotes, ctx)
 
-		go countEmotes(ctx, incomingMessages, db, initEmotesToTrack, tokenManager, liveStatus, latestEmotes)
+		go countEmotes(ctx, incomingMessages, db, initEmotesToTrack, tokenManager, liveStatus, liveBroadcaster, latestEmotes)
 
 		<-ctx.Done()
 		cancel()
@@ -556,6 +783,7 @@ func countEmotes(
 	trackingEmotes map[int]Emote,
 	tokenManager *TokenManager,
 	liveStatus *LiveStatus,
+	liveBroadcaster *LiveBroadcaster,
 	emoteUpdates <-chan map[int]Emote,
 ) {
 	env := GetConfig()
@@ -573,24 +801,34 @@ func countEmotes(
 
 	resetCounter()
 
+	spikeDetector := newSpikeDetector(db)
+	cooccurrence := newCooccurrenceCounter()
+	matchers := trackerMatchers(trackingEmotes)
+
 	for {
 		select {
 		case msg := <-message:
 			message := string(msg.Data)
 			messageText := splitAndGetLast(message, "#northernlion")
+			emotesInMessage := make([]int, 0)
 
 			for _, emote := range trackingEmotes {
 				if emote.Code == "two" {
 					continue
 				}
-				if strings.Contains(messageText, emote.Code) {
+				if matchesMessage(emote, matchers, messageText) {
 					if env.Debug {
 						fmt.Println("found emote", emote.Code)
 					}
 					counter[int(emote.ID)] += 1
+					emotesInMessage = append(emotesInMessage, int(emote.ID))
 				}
 			}
 
+			if strings.Contains(message, "PRIVMSG") {
+				cooccurrence.countMessage(emotesInMessage)
+			}
+
 			twoEmoteId := -1
 
 			for _, emote := range trackingEmotes {
@@ -629,7 +867,14 @@ func countEmotes(
 
 			resetCounter()
 
-			go persistCountsIfLive(db, counts, tokenManager, liveStatus)
+			now := time.Now()
+			spikes := spikeDetector.observe(counts, now)
+			liveBroadcaster.publishBucket(counts, now)
+
+			pairCounts, messageCount := cooccurrence.flush(now)
+			go persistCooccurrenceIfLive(db, pairCounts, messageCount, liveStatus)
+
+			go persistCountsIfLive(db, counts, spikes, tokenManager, liveStatus, liveBroadcaster)
 
 		case refreshedEmotes := <-emoteUpdates:
 			for _, emote := range refreshedEmotes {
@@ -639,6 +884,7 @@ func countEmotes(
 
 			}
 			trackingEmotes = refreshedEmotes
+			matchers = trackerMatchers(trackingEmotes)
 
 		case <-ctx.Done():
 			return
@@ -649,8 +895,10 @@ func countEmotes(
 func persistCountsIfLive(
 	db *gorm.DB,
 	counts []EmoteCount,
+	spikes []Spike,
 	tokenManager *TokenManager,
 	liveStatus *LiveStatus,
+	liveBroadcaster *LiveBroadcaster,
 	retries ...int) {
 
 	env := GetConfig()
@@ -667,7 +915,7 @@ func persistCountsIfLive(
 
 	if clipResult.clipID != "" {
 
-		liveStatus.setLiveStatus(true, db)
+		liveStatus.setLiveStatus(true, db, tokenManager)
 		countsWithClipIDs := make([]EmoteCount, 0, len(counts))
 
 		for _, count := range counts {
@@ -684,13 +932,29 @@ func persistCountsIfLive(
 
 		if err != nil {
 			fmt.Println("Error creating clip: ", clipResult.error)
-			liveStatus.setLiveStatus(false, db)
+			liveStatus.setLiveStatus(false, db, tokenManager)
 		}
 
 		err = db.Create(&countsWithClipIDs).Error
 
 		if err != nil {
 			fmt.Println("Error inserting into db:", err)
+		} else {
+			responses.invalidateLatest()
+		}
+
+		if len(spikes) > 0 {
+			for i := range spikes {
+				spikes[i].ClipID = clipResult.clipID
+			}
+
+			err = db.Create(&spikes).Error
+
+			if err != nil {
+				fmt.Println("Error inserting spikes:", err)
+			}
+
+			liveBroadcaster.publishSpikes(spikes)
 		}
 
 		if env.Debug {
@@ -703,11 +967,11 @@ func persistCountsIfLive(
 		tokenManager.RefreshToken(db)
 
 		if len(retries) == 0 {
-			persistCountsIfLive(db, counts, tokenManager, liveStatus, 1)
+			persistCountsIfLive(db, counts, spikes, tokenManager, liveStatus, liveBroadcaster, 1)
 		}
 	} else {
 		fmt.Println("Error creating clip: ", clipResult.error)
-		liveStatus.setLiveStatus(false, db)
+		liveStatus.setLiveStatus(false, db, tokenManager)
 	}
 
 }
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an in-process cache of whole GET responses, keyed by path, sorted query and Accept.
+// entries are dropped by what could have changed them rather than by age:
+//
+//	latest, anything read up to now, goes with every new 10 second batch
+//	historical, anything with a fixed end, goes when an aggregate refresh reaches it
+//	top clips go when the top clips store is rebuilt
+//
+// anything that isn't a GET and succeeds clears the lot.
+type ResponseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	entries  map[string]*list.Element
+	// most recently used at the front
+	order *list.List
+	// bumped by every invalidation of a scope, so a response computed before one isn't
+	// stored after it
+	generations map[cacheScope]uint64
+}
+
+type cacheScope int
+
+const (
+	scopeLatest cacheScope = iota
+	scopeHistorical
+	scopeTopClips
+)
+
+type cachedResponse struct {
+	key   string
+	scope cacheScope
+	// the end of the range a historical response read
+	to      time.Time
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+const (
+	responseCacheBytes = 64 << 20
+	// one response can't take more than this share of the cache
+	maxCachedResponseBytes = responseCacheBytes / 16
+	// a backstop for changes nothing tells us about, eg timescale's own refresh policies
+	responseCacheTTL = time.Hour
+)
+
+// streams, side effects, calls out to twitch, and answers that change with data after
+// the time they're asked about
+var uncachedPaths = []string{
+	"/api/live",
+	"/api/next_stream_date",
+	"/api/export",
+	"/api/is_live",
+	"/api/thumbnail",
+	"/api/initialize_top_clips",
+}
+
+var responses = newResponseCache(responseCacheBytes)
+
+func newResponseCache(maxBytes int) *ResponseCache {
+	return &ResponseCache{
+		maxBytes:    maxBytes,
+		entries:     make(map[string]*list.Element),
+		order:       list.New(),
+		generations: make(map[cacheScope]uint64),
+	}
+}
+
+func (c *ResponseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+
+	c.order.MoveToFront(element)
+	return entry
+}
+
+func (c *ResponseCache) generation(scope cacheScope) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generations[scope]
+}
+
+// stores the entry, unless its scope was invalidated since generation was read
+func (c *ResponseCache) put(entry *cachedResponse, generation uint64) {
+	if len(entry.body) > maxCachedResponseBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.generations[entry.scope] != generation {
+		return
+	}
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += len(entry.body)
+
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// callers hold the lock
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := element.Value.(*cachedResponse)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+func (c *ResponseCache) invalidate(scopes []cacheScope, stale func(entry *cachedResponse) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, scope := range scopes {
+		c.generations[scope]++
+	}
+
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if stale(element.Value.(*cachedResponse)) {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+// a new batch of counts only changes what reads up to now
+func (c *ResponseCache) invalidateLatest() {
+	c.invalidate([]cacheScope{scopeLatest}, func(entry *cachedResponse) bool {
+		return entry.scope == scopeLatest
+	})
+}
+
+// an aggregate refresh rewrote buckets from since on, so any range that reaches
+// them is stale
+func (c *ResponseCache) invalidateSince(since time.Time) {
+	c.invalidate([]cacheScope{scopeLatest, scopeHistorical}, func(entry *cachedResponse) bool {
+		return entry.scope == scopeLatest || (entry.scope == scopeHistorical && !entry.to.Before(since))
+	})
+}
+
+func (c *ResponseCache) invalidateScope(scope cacheScope) {
+	c.invalidate([]cacheScope{scope}, func(entry *cachedResponse) bool {
+		return entry.scope == scope
+	})
+}
+
+func (c *ResponseCache) invalidateAll() {
+	c.invalidate([]cacheScope{scopeLatest, scopeHistorical, scopeTopClips}, func(entry *cachedResponse) bool {
+		return true
+	})
+}
+
+func cacheKey(r *http.Request) string {
+	query := r.URL.Query()
+
+	for name, values := range query {
+		values = slices.DeleteFunc(values, func(value string) bool { return value == "" })
+		if len(values) == 0 {
+			delete(query, name)
+			continue
+		}
+
+		slices.Sort(values)
+		query[name] = values
+	}
+
+	return r.URL.Path + "?" + query.Encode() + "|" + r.Header.Get("Accept")
+}
+
+// how a request's response can go stale, and false when it shouldn't be cached
+func cacheScopeOf(r *http.Request) (cacheScope, time.Time, bool) {
+	path := r.URL.Path
+
+	if r.Method != http.MethodGet || !strings.HasPrefix(path, "/api/") || slices.Contains(uncachedPaths, path) {
+		return 0, time.Time{}, false
+	}
+
+	// only a tracked span on its own is read from the stored rankings
+	if path == "/api/hero_all_time_clips" && !hasWindow(r.URL.Query()) {
+		return scopeTopClips, time.Time{}, true
+	}
+
+	// the day page links on to the next stream, which any new stream can change
+	if path == "/api/day" {
+		return scopeLatest, time.Time{}, true
+	}
+
+	end, ok := requestEnd(r.URL.Query())
+	if !ok || !end.Before(time.Now()) {
+		return scopeLatest, time.Time{}, true
+	}
+
+	return scopeHistorical, end, true
+}
+
+// whether a request pins its window down past a named span
+func hasWindow(query url.Values) bool {
+	for _, param := range []string{"date", "from", "to", "duration", "stream_id", "last_streams"} {
+		if query.Get(param) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// the latest time a request reads, when it pins one down. the window is resolved just
+// as the endpoints resolve it, so eg a date on its own ends with its channel day.
+// anything else, like a duration back from the latest data or a stream that may still
+// be live, reads up to now.
+func requestEnd(query url.Values) (time.Time, bool) {
+	if query.Get("stream_id") != "" || query.Get("last_streams") != "" {
+		return time.Time{}, false
+	}
+
+	window := TimeWindow{
+		Duration: query.Get("duration"),
+		Span:     query.Get("span"),
+	}
+
+	for bound, value := range map[*time.Time]string{&window.From: query.Get("from"), &window.To: query.Get("to")} {
+		if value == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false
+		}
+		*bound = parsed
+	}
+
+	// a window's date is a bare calendar date, other endpoints' dates are instants.
+	// either is read as the channel's day, and the day after is read too, eg for growth
+	// against the day before.
+	dayAfter := time.Time{}
+	if date := query.Get("date"); date != "" {
+		parsed, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			parsed, err = time.Parse(time.RFC3339Nano, date)
+		}
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		window.Date = parsed
+		dayAfter = channelDay(parsed).AddDate(0, 0, 2)
+	}
+
+	// with no bound the window hangs off the latest data
+	if window.Date.IsZero() && window.From.IsZero() && window.To.IsZero() {
+		return time.Time{}, false
+	}
+
+	// with a bound given, resolving never reaches the database
+	resolved, err := window.resolve(nil, "")
+	if err != nil || resolved.To.IsZero() {
+		return time.Time{}, false
+	}
+
+	// buckets are read whole, so the response depends on everything up to the end of
+	// the bucket holding its last time
+	grouping := query.Get("grouping")
+	if _, ok := groupingToDuration[grouping]; !ok {
+		grouping = coarsestGrouping(resolved, query.Get("max_points"))
+	}
+
+	end := nextBucket(grouping, bucketStart(grouping, resolved.To))
+	if dayAfter.After(end) {
+		end = dayAfter
+	}
+
+	return end, true
+}
+
+// the coarsest grouping an endpoint could pick for the window by itself, either to
+// sum over it or to chart it
+func coarsestGrouping(window ResolvedWindow, maxPoints string) string {
+	if window.From.IsZero() {
+		return "year"
+	}
+
+	points, _ := strconv.Atoi(maxPoints)
+
+	// with a from, the window has a length and earliest is never needed
+	charted, _ := autoGrouping(window, points, seriesGroupings, nil)
+
+	summed := window.sumGrouping()
+	if groupingToDuration[summed] > groupingToDuration[charted] {
+		return summed
+	}
+
+	return charted
+}
+
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	for name, values := range entry.header {
+		w.Header()[name] = values
+	}
+
+	w.Header().Set("ETag", entry.etag)
+	w.Header().Add("Vary", "Accept")
+
+	if etagMatches(r.Header.Get("If-None-Match"), entry.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// holds the whole response back, so its etag can go in the headers. it keeps its own
+// headers so the ones cors set for this request's origin aren't replayed to another.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (c *ResponseCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status < http.StatusBadRequest {
+				c.invalidateAll()
+			}
+			return
+		}
+
+		scope, to, ok := cacheScopeOf(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cacheKey(r)
+
+		if entry := c.get(key); entry != nil {
+			writeCachedResponse(w, r, entry)
+			return
+		}
+
+		generation := c.generation(scope)
+
+		buffered := &bufferedResponseWriter{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(buffered, r)
+
+		entry := &cachedResponse{
+			key:     key,
+			scope:   scope,
+			to:      to,
+			status:  buffered.status,
+			header:  buffered.header,
+			body:    buffered.body.Bytes(),
+			etag:    responseETag(buffered.body.Bytes()),
+			expires: time.Now().Add(responseCacheTTL),
+		}
+
+		if entry.status == http.StatusOK {
+			c.put(entry, generation)
+		}
+
+		writeCachedResponse(w, r, entry)
+	})
+}
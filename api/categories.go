@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+// a stretch of stream spent in one category with one title. EndedAt is nil for the
+// segment we're currently in.
+type CategorySegment struct {
+	gorm.Model
+	StreamID  uint       `gorm:"index" json:"stream_id"`
+	Category  string     `gorm:"index" json:"category"`
+	Title     string     `json:"title"`
+	StartedAt time.Time  `gorm:"index" json:"started_at"`
+	EndedAt   *time.Time `gorm:"index" json:"ended_at"`
+}
+
+type TwitchChannel struct {
+	BroadcasterID string `json:"broadcaster_id"`
+	GameName      string `json:"game_name"`
+	Title         string `json:"title"`
+}
+
+type TwitchChannelResponse struct {
+	Data []TwitchChannel `json:"data"`
+}
+
+const categoryPollInterval = time.Minute
+
+type CategoryEmotesInput struct {
+	TimeWindow
+	EmoteIDs []int   `query:"emote_ids"`
+	MinHours float64 `query:"min_hours" default:"1" minimum:"0"`
+	Limit    int     `query:"limit" default:"50" minimum:"1" maximum:"500"`
+}
+
+type CategoryEmoteRate struct {
+	Category string  `json:"category"`
+	Hours    float64 `json:"hours"`
+	EmoteID  int     `json:"emote_id"`
+	Code     string  `json:"code"`
+	EmoteURL string  `json:"emote_url"`
+	Sum      int     `json:"sum"`
+	PerHour  float64 `json:"per_hour"`
+}
+
+type CategoryEmotesOutput struct {
+	Body []CategoryEmoteRate
+}
+
+func pollChannelCategory(db *gorm.DB, tokenManager *TokenManager, liveStatus *LiveStatus) {
+	ticker := time.NewTicker(categoryPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		isLive, streamID := liveStatus.current()
+
+		if !isLive {
+			err := closeCategorySegment(db, time.Now())
+			if err != nil {
+				fmt.Println("error closing category segment", err)
+			}
+			continue
+		}
+
+		channel, err := fetchChannelInfo(tokenManager)
+		if err != nil {
+			fmt.Println("error fetching channel info", err)
+			continue
+		}
+
+		err = updateCategorySegment(db, streamID, channel.GameName, channel.Title, time.Now())
+		if err != nil {
+			fmt.Println("error updating category segment", err)
+		}
+	}
+}
+
+// closes the current segment and opens one for the category and title at the given
+// time, unless they haven't changed
+func updateCategorySegment(db *gorm.DB, streamID uint, category string, title string, at time.Time) error {
+	var current CategorySegment
+
+	err := db.Where("ended_at IS NULL").Order("started_at DESC").Limit(1).Find(&current).Error
+	if err != nil {
+		return err
+	}
+
+	if current.ID != 0 && current.Category == category && current.Title == title && current.StreamID == streamID {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if current.ID != 0 {
+			if err := tx.Model(&current).Update("ended_at", at).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&CategorySegment{
+			StreamID:  streamID,
+			Category:  category,
+			Title:     title,
+			StartedAt: at,
+		}).Error
+	})
+}
+
+func closeCategorySegment(db *gorm.DB, at time.Time) error {
+	return db.Model(&CategorySegment{}).Where("ended_at IS NULL").Update("ended_at", at).Error
+}
+
+func fetchChannelInfo(tokenManager *TokenManager) (*TwitchChannel, error) {
+	var response TwitchChannelResponse
+
+	err := getHelix(fmt.Sprintf("https://api.twitch.tv/helix/channels?broadcaster_id=%s", nlBroadcasterID), tokenManager, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Data) == 0 {
+		return nil, fmt.Errorf("no channel info found")
+	}
+
+	return &response.Data[0], nil
+}
+
+// limits a query to the time spent in a category. with a bucket width, only buckets
+// that lie wholly inside a segment are kept, so a bucket shared with the game before
+// or after is left out rather than counted for both. the current segment has no end
+// yet, so its latest bucket is kept.
+func filterByCategory(query sq.SelectBuilder, column string, category string, bucketWidth ...string) sq.SelectBuilder {
+	upperBound := fmt.Sprintf("%s < COALESCE(cs.ended_at, now())", column)
+	if len(bucketWidth) > 0 && bucketWidth[0] != "" {
+		upperBound = fmt.Sprintf("(cs.ended_at IS NULL OR %s + INTERVAL '%s' <= cs.ended_at)", column, bucketWidth[0])
+	}
+
+	return query.Where(statementBuilder().
+		Select("1").
+		From("category_segments cs").
+		Where(sq.Eq{"cs.category": category, "cs.deleted_at": nil}).
+		Where(fmt.Sprintf("%s >= cs.started_at", column)).
+		Where(upperBound).
+		Prefix("EXISTS (").
+		Suffix(")"))
+}
+
+// which game makes chat say an emote the most, normalized by how long each game was played
+func selectCategoryEmotes(p CategoryEmotesInput, db *gorm.DB) (*CategoryEmotesOutput, error) {
+	// all time unless asked otherwise, a game needs a lot of hours for a fair rate
+	window, err := p.TimeWindow.resolve(db, "")
+	if err != nil {
+		return &CategoryEmotesOutput{}, err
+	}
+
+	segments := statementBuilder().
+		Select("category", "started_at", "COALESCE(ended_at, now()) as ended_at").
+		From("category_segments").
+		Where(sq.Eq{"deleted_at": nil}).
+		Where(sq.NotEq{"category": ""})
+
+	segments = window.where(segments, "started_at")
+
+	hoursPlayed := statementBuilder().
+		Select("category", "SUM(EXTRACT(EPOCH FROM ended_at - started_at)) / 3600 as hours").
+		FromSelect(segments, "segments").
+		GroupBy("category")
+
+	emoteFilter := notTwo()
+	if len(p.EmoteIDs) > 0 {
+		emoteFilter = sq.Eq{"series.emote_id": p.EmoteIDs}
+	}
+
+	sums := statementBuilder().
+		Select("segments.category", "series.emote_id", "SUM(series.sum) as sum").
+		FromSelect(segments, "segments").
+		Join(fmt.Sprintf("%s series ON series.bucket >= segments.started_at AND series.bucket < segments.ended_at", secondViewAggregate)).
+		Where(emoteFilter).
+		GroupBy("segments.category", "series.emote_id")
+
+	query, args, err := statementBuilder().
+		Select(
+			"sums.category",
+			"hours_played.hours",
+			"sums.emote_id",
+			"code",
+			"url as emote_url",
+			"sums.sum",
+			"sums.sum / NULLIF(hours_played.hours, 0) as per_hour").
+		FromSelect(sums, "sums").
+		JoinClause(hoursPlayed.Prefix("JOIN (").Suffix(") hours_played ON hours_played.category = sums.category")).
+		Join("emotes on emotes.id = sums.emote_id").
+		Where(sq.GtOrEq{"hours_played.hours": p.MinHours}).
+		OrderBy("per_hour DESC").
+		Limit(uint64(p.Limit)).
+		ToSql()
+	if err != nil {
+		return &CategoryEmotesOutput{}, err
+	}
+
+	rates := []CategoryEmoteRate{}
+
+	err = db.Raw(query, args...).Scan(&rates).Error
+	if err != nil {
+		fmt.Println("error fetching category emote rates", err)
+		return &CategoryEmotesOutput{}, err
+	}
+
+	return &CategoryEmotesOutput{Body: rates}, nil
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/lib/pq"
 	"gorm.io/gorm"
 )
 
@@ -19,19 +21,27 @@ type Clip struct {
 	Count     int       `json:"count"`
 	Time      time.Time `json:"time"`
 	Thumbnail string    `json:"thumbnail"`
+	// the composite's rolling value, when peaks were ranked by a composite index
+	Value *float64 `json:"value,omitempty"`
+	// the peak the clip was picked for, which is what pages are keyed on
+	PeakSum float64   `json:"-"`
+	PeakAt  time.Time `json:"-"`
 }
 
 type ClipCountsInput struct {
 	EmoteID int `query:"emote_id" default:"2"`
-	SpanQuery
-	Grouping string    `query:"grouping" default:"hour" enum:"25 seconds,1 minute,5 minutes,15 minutes,1 hour,1 day"`
-	Order    string    `query:"order" default:"DESC" enum:"ASC,DESC"`
-	Limit    int       `query:"limit" default:"10"`
-	From     time.Time `query:"from"`
+	TimeWindow
+	Grouping string `query:"grouping" default:"1 hour" enum:"25 seconds,1 minute,5 minutes,15 minutes,1 hour,1 day"`
+	Order    string `query:"order" default:"DESC" enum:"ASC,DESC"`
+	Limit    int    `query:"limit" default:"10" minimum:"1" maximum:"100"`
+	Cursor   string `query:"cursor"`
+	// rank peaks of a composite index instead of a single emote
+	CompositeID int `query:"composite_id"`
 }
 
 type ClipCountsOutput struct {
-	Body []Clip `json:"clips"`
+	NextCursor string `header:"X-Next-Cursor"`
+	Body       []Clip `json:"clips"`
 }
 
 // when discovering high rolling sum, we want to eliminate building values
@@ -39,74 +49,89 @@ type ClipCountsOutput struct {
 // the solution is to filter rows within the likelyBitLength window
 const likelyBitLength = "1 minutes"
 
+// the rolling windows peaks can be ranked over, as ClipCountsInput's enum. it's
+// written into the query, so callers that skip validation are checked against it.
+var clipGroupings = []string{"25 seconds", "1 minute", "5 minutes", "15 minutes", "1 hour", "1 day"}
+
 func selectClipsFromEmotePeaks(p ClipCountsInput, db *gorm.DB) (*ClipCountsOutput, error) {
 	fmt.Println("fetching clips for input", p)
 
-	var query string
+	if !slices.Contains(clipGroupings, p.Grouping) {
+		return &ClipCountsOutput{}, huma.Error422UnprocessableEntity(fmt.Sprintf("unsupported grouping %s", p.Grouping))
+	}
 
-	// we want just the x top comedic segments, but some segments have many clips in the top rankings
-	// so we limit to a reasonable value.
-	limitMap := map[string]int{
-		"25 seconds": 100,
-		"1 minute":   300,
-		"5 minutes":  1500,
-		"15 minutes": 4500,
-		"1 hour":     18000,
-		"1 day":      432000,
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &ClipCountsOutput{}, err
 	}
 
+	filters := window.sql("emote_counts.created_at")
+
 	rollingSumQuery := fmt.Sprintf(`
 	SELECT created_at, SUM(count) OVER (                                                   
 		ORDER BY created_at                                                                    
 		RANGE BETWEEN INTERVAL '%s' PRECEDING AND CURRENT ROW
 	) AS rolling_sum
 	FROM emote_counts
-	WHERE emote_id = $2
-	`, p.Grouping)
-
-	if !p.From.IsZero() {
-		rollingSumQuery = fmt.Sprintf(`
-			%s
-			AND emote_counts.created_at >= '%s' AND emote_counts.created_at < '%s'
-			`,
-			rollingSumQuery,
-			p.From.Format("2006-01-02 15:04:05"),
-			p.From.Add(time.Hour*24).Format("2006-01-02 15:04:05"))
-	} else if p.Span != "" && p.Span != AllTime {
-		rollingSumQuery = fmt.Sprintf(`
-			%s 
-			AND created_at >= (
-				SELECT MAX(created_at) - INTERVAL '%s'
-				FROM emote_counts
-			)`, rollingSumQuery, p.Span)
-
-	}
-
-	rollingSumQuery = fmt.Sprintf("%s ORDER BY rolling_sum %s LIMIT %d", rollingSumQuery, p.Order, limitMap[p.Grouping])
-
-	query = fmt.Sprintf(`
-	WITH RollingSums AS (%s),
-	RankedIntervals AS (
-		SELECT created_at, rolling_sum, ROW_NUMBER() 
-		OVER (
-			ORDER BY rolling_sum %s, created_at DESC
-		) AS rn
-		FROM RollingSums
-	),
-	FilteredIntervals AS (
-		SELECT r1.created_at AS max_created_at, r1.rolling_sum
-		FROM RankedIntervals r1
-		WHERE NOT EXISTS (
-			SELECT 1
-		    	FROM RankedIntervals r2
-		    	WHERE r2.rn < r1.rn
-		      	AND r2.created_at >= r1.created_at - INTERVAL '%s'
-		      	AND r2.created_at <= r1.created_at + INTERVAL '%s'
-		)
-		LIMIT $1
-	)
-	SELECT fi.rolling_sum as count, ec.created_at AS time, ec.clip_id
-	FROM FilteredIntervals fi
+	WHERE emote_id = $1
+	%s
+	`, p.Grouping, filters)
+
+	rollingSumArgs := []any{p.EmoteID}
+	clipEmoteFilter := fmt.Sprintf("ec.emote_id = %d", p.EmoteID)
+	countColumns := "fi.rolling_sum as count"
+
+	if p.CompositeID != 0 {
+		composites, err := loadComposites([]int{p.CompositeID}, db)
+		if err != nil {
+			return &ClipCountsOutput{}, err
+		}
+
+		node, err := parseComposite(composites[0].Expression)
+		if err != nil {
+			return &ClipCountsOutput{}, err
+		}
+
+		rollingSumQuery = compositeRollingSum(node, p.Grouping, filters)
+		rollingSumArgs = nil
+
+		// the clip comes from whichever of the composite's emotes was busiest
+		clipEmoteFilter = "true"
+		if !node.usesBaseline(baselineEmotes) {
+			clipEmoteFilter = fmt.Sprintf("ec.emote_id IN (%s)", node.emoteIDList())
+		}
+
+		// composites aren't whole numbers, so the value is reported alongside a rounded count
+		countColumns = "ROUND(fi.rolling_sum)::int as count, fi.rolling_sum as value"
+	}
+
+	// peaks are ranked by rolling sum then latest first, so a page carries on from the
+	// last peak's place in that order
+	var after Clip
+	paged, err := decodeCursor(p.Cursor, &after.PeakSum, &after.PeakAt)
+	if err != nil {
+		return &ClipCountsOutput{}, err
+	}
+
+	pastCursor := func(peak rollingSum) bool {
+		if !paged {
+			return true
+		}
+		if peak.RollingSum == after.PeakSum {
+			return peak.CreatedAt.Before(after.PeakAt)
+		}
+		if p.Order == "ASC" {
+			return peak.RollingSum > after.PeakSum
+		}
+		return peak.RollingSum < after.PeakSum
+	}
+
+	// the clip is picked from the 25 seconds before each peak. a peak whose clips are all
+	// dead drops out here, so the limit is applied after, and one past it tells whether
+	// there's another page.
+	clipsQuery := fmt.Sprintf(`
+	SELECT %s, ec.created_at AS time, ec.clip_id, fi.rolling_sum as peak_sum, fi.max_created_at as peak_at
+	FROM unnest($1::timestamptz[], $2::float8[]) WITH ORDINALITY AS fi(max_created_at, rolling_sum, rn)
 	CROSS JOIN LATERAL (
 		SELECT 
 		    ec.created_at, 
@@ -114,21 +139,114 @@ func selectClipsFromEmotePeaks(p ClipCountsInput, db *gorm.DB) (*ClipCountsOutpu
 		    ec.count
 		FROM emote_counts ec
 		WHERE ec.created_at BETWEEN fi.max_created_at - INTERVAL '25 seconds' AND fi.max_created_at + INTERVAL '1 second'
-		AND ec.emote_id = $2
+		AND %s
+		AND ec.clip_id NOT IN (SELECT clip_id FROM fetched_clips WHERE dead)
 		ORDER BY ec.count %s
 		LIMIT 1
-	) ec;
-	`, rollingSumQuery, p.Order, likelyBitLength, likelyBitLength, p.Order)
+	) ec
+	ORDER BY fi.rn
+	LIMIT $3;
+	`, countColumns, clipEmoteFilter, p.Order)
 
 	var clips []Clip
-	err := db.Raw(query, p.Limit, p.EmoteID).Scan(&clips).Error
+
+	// only the best rolling sums can be peaks, so they're ranked from a bounded set of
+	// them. the set grows until it holds the page, or every rolling sum in the window.
+	for candidates := (p.Limit + 1) * candidatesPerPeak(p.Grouping); ; candidates *= 4 {
+		var sums []rollingSum
+
+		err = db.Raw(fmt.Sprintf("%s ORDER BY rolling_sum %s, created_at DESC LIMIT %d", rollingSumQuery, p.Order, candidates), rollingSumArgs...).Scan(&sums).Error
+		if err != nil {
+			fmt.Println(err)
+			return &ClipCountsOutput{}, err
+		}
+
+		times := make([]string, 0)
+		values := make([]float64, 0)
+
+		for _, peak := range separatePeaks(sums) {
+			if pastCursor(peak) {
+				times = append(times, peak.CreatedAt.Format(time.RFC3339Nano))
+				values = append(values, peak.RollingSum)
+			}
+		}
+
+		err = db.Raw(clipsQuery, pq.Array(times), pq.Array(values), p.Limit+1).Scan(&clips).Error
+		if err != nil {
+			fmt.Println(err)
+			return &ClipCountsOutput{}, err
+		}
+
+		if len(clips) > p.Limit || len(sums) < candidates {
+			break
+		}
+	}
+
+	page := pageOf(clips, p.Limit, func(clip Clip) []any {
+		return []any{clip.PeakSum, clip.PeakAt}
+	})
+
+	return &ClipCountsOutput{NextCursor: page.NextCursor, Body: page.Items}, nil
+}
+
+type rollingSum struct {
+	CreatedAt  time.Time
+	RollingSum float64
+}
+
+// a peak's rolling sum stays near its height for about a grouping either side of it,
+// a row per 10 seconds, so that many rows can rank above the next peak
+func candidatesPerPeak(grouping string) int {
+	width, err := parseBucketWidth(grouping)
 	if err != nil {
-		fmt.Println(err)
-		return &ClipCountsOutput{}, err
+		width = time.Minute
 	}
-	return &ClipCountsOutput{
-		clips,
-	}, nil
+
+	return int(2*width/(10*time.Second)) + 12
+}
+
+// the rows, in rank order, that rank above every other row within likelyBitLength of
+// them, so a build up to a peak isn't counted as peaks of its own. every row ranked
+// above one in sums is in sums too, so the answer doesn't depend on where sums stops.
+func separatePeaks(sums []rollingSum) []rollingSum {
+	// matches likelyBitLength
+	window := time.Minute
+
+	byTime := make([]int, len(sums))
+	for i := range byTime {
+		byTime[i] = i
+	}
+	slices.SortFunc(byTime, func(i, j int) int {
+		return sums[i].CreatedAt.Compare(sums[j].CreatedAt)
+	})
+
+	isPeak := make([]bool, len(sums))
+
+	for position, rank := range byTime {
+		isPeak[rank] = true
+		at := sums[rank].CreatedAt
+
+		for other := position - 1; other >= 0 && at.Sub(sums[byTime[other]].CreatedAt) <= window; other-- {
+			if byTime[other] < rank {
+				isPeak[rank] = false
+			}
+		}
+
+		for other := position + 1; other < len(byTime) && sums[byTime[other]].CreatedAt.Sub(at) <= window; other++ {
+			if byTime[other] < rank {
+				isPeak[rank] = false
+			}
+		}
+	}
+
+	peaks := make([]rollingSum, 0)
+	for rank, sum := range sums {
+		if isPeak[rank] {
+			peaks = append(peaks, sum)
+		}
+	}
+
+	return peaks
 }
 
 type NearestClipInput struct {
@@ -170,10 +288,11 @@ func selectNearestClip(p NearestClipInput, db *gorm.DB) (*NearestClipOutput, err
 }
 
 type AllTimeClipsInput struct {
-	Limit    int   `query:"limit"`
-	Cursor   int   `query:"cursor"`
-	EmoteIDs []int `query:"emote_ids"`
-	SpanQuery
+	// emotes per page, ranked by their sum over the span
+	Limit    int    `query:"limit" default:"20" minimum:"1" maximum:"50"`
+	Cursor   string `query:"cursor"`
+	EmoteIDs []int  `query:"emote_ids"`
+	TimeWindow
 }
 
 type EmoteAllTime struct {
@@ -193,7 +312,8 @@ type EmoteWithClips struct {
 }
 
 type AllTimeClipsOutput struct {
-	Body []EmoteWithClips
+	NextCursor string `header:"X-Next-Cursor"`
+	Body       []EmoteWithClips
 }
 
 // Define a custom type for the union values
@@ -285,11 +405,11 @@ func topClips(span TimeRange, emotes []Emote, db *gorm.DB) (chan ClipUpdateResul
 
 	for _, emoteToQuery := range emotes {
 		jobs <- ClipCountsInput{
-			EmoteID:   int(emoteToQuery.ID),
-			SpanQuery: SpanQuery{Span: span},
-			Grouping:  "25 seconds",
-			Limit:     limitForSpan,
-			Order:     "DESC",
+			EmoteID:    int(emoteToQuery.ID),
+			TimeWindow: TimeWindow{Span: string(span)},
+			Grouping:   "25 seconds",
+			Limit:      limitForSpan,
+			Order:      "DESC",
 		}
 	}
 
@@ -402,40 +522,145 @@ var timeSpansToTrack = []TimeRange{
 	AllTime,
 }
 
-func heroTopClips(input *SpanQuery, db *gorm.DB) (*AllTimeClipsOutput, error) {
-	grouping := "day"
-	if input.Span == Last9Hours {
-		grouping = "hour"
+// more emotes than we've ever tracked, so the ranking heroTopClips pages through is all of them
+const maxRankedEmotes = 1000
+
+func heroTopClips(p AllTimeClipsInput, db *gorm.DB) (*AllTimeClipsOutput, error) {
+	window := p.TimeWindow
+	if window == (TimeWindow{}) {
+		window.Span = string(Last9Hours)
+	}
+
+	// a tracked span on its own is read from the stored rankings, anything else is
+	// worked out from the peaks in the window
+	stored := window == (TimeWindow{Span: window.Span}) && slices.Contains(timeSpansToTrack, TimeRange(window.Span))
+
+	grouping := ""
+	if stored {
+		grouping = "day"
+		if window.Span == string(Last9Hours) {
+			grouping = "hour"
+		}
 	}
-	topTwentyEmotesPastSpan, err := selectSums(db, EmoteSumInput{
-		Span:     string(input.Span),
-		Limit:    20,
-		Grouping: grouping,
+
+	var after EmoteSum
+	paged, err := decodeCursor(p.Cursor, &after.Sum, &after.EmoteID)
+	if err != nil {
+		return &AllTimeClipsOutput{}, err
+	}
+
+	sums, err := selectSums(db, EmoteSumInput{
+		TimeWindow: window,
+		Limit:      maxRankedEmotes,
+		Grouping:   grouping,
 	})
 	if err != nil {
-		fmt.Println("error fetching top 20 emotes", err)
+		fmt.Println("error ranking emotes", err)
 		return &AllTimeClipsOutput{}, err
 	}
 
-	emoteIds := make([]int, 0, len(topTwentyEmotesPastSpan.Body.Emotes))
+	ranking := make([]EmoteSum, 0, len(sums.Body.Emotes))
+	for _, emote := range sums.Body.Emotes {
+		if len(p.EmoteIDs) > 0 && !slices.Contains(p.EmoteIDs, emote.EmoteID) {
+			continue
+		}
 
-	for _, emote := range topTwentyEmotesPastSpan.Body.Emotes {
-		emoteIds = append(emoteIds, emote.EmoteID)
+		if paged && (emote.Sum > after.Sum || (emote.Sum == after.Sum && emote.EmoteID <= after.EmoteID)) {
+			continue
+		}
+
+		ranking = append(ranking, emote)
 	}
-	emoteIdToSpanSum := make(map[int]EmoteSum, len(topTwentyEmotesPastSpan.Body.Emotes))
-	for _, emote := range topTwentyEmotesPastSpan.Body.Emotes {
+
+	slices.SortFunc(ranking, func(a, b EmoteSum) int {
+		if a.Sum != b.Sum {
+			return b.Sum - a.Sum
+		}
+		return a.EmoteID - b.EmoteID
+	})
+
+	page := pageOf(ranking, p.Limit, func(emote EmoteSum) []any {
+		return []any{emote.Sum, emote.EmoteID}
+	})
+
+	emoteIds := make([]int, 0, len(page.Items))
+	emoteIdToSpanSum := make(map[int]EmoteSum, len(page.Items))
+	for _, emote := range page.Items {
+		emoteIds = append(emoteIds, emote.EmoteID)
 		emoteIdToSpanSum[emote.EmoteID] = emote
 	}
-	fmt.Println(emoteIdToSpanSum)
 
-	results, err := storedTopClips(input.Span, emoteIds, db)
+	var results []TopClip
+	if stored {
+		results, err = storedTopClips(TimeRange(window.Span), emoteIds, db)
+	} else {
+		results, err = windowTopClips(window, page.Items, db)
+	}
 	if err != nil {
 		fmt.Println("error fetching clips for emote", err)
 		return &AllTimeClipsOutput{}, err
 	}
+
+	// in ranking order. an emote without stored clips yet is left out of its page
 	emotesWithClips := topClipsToEmoteWithClips(results, emoteIdToSpanSum)
+	slices.SortFunc(emotesWithClips, func(a, b EmoteWithClips) int {
+		return slices.Index(emoteIds, a.EmoteID) - slices.Index(emoteIds, b.EmoteID)
+	})
+
+	return &AllTimeClipsOutput{
+		NextCursor: page.NextCursor,
+		Body:       append([]EmoteWithClips{}, emotesWithClips...),
+	}, nil
+}
+
+// the top clips of each emote over a window the stored rankings don't cover
+func windowTopClips(window TimeWindow, emotes []EmoteSum, db *gorm.DB) ([]TopClip, error) {
+	var results []TopClip
 
-	return &AllTimeClipsOutput{Body: emotesWithClips}, nil
+	for _, emote := range emotes {
+		clips, err := selectClipsFromEmotePeaks(ClipCountsInput{
+			EmoteID:    emote.EmoteID,
+			TimeWindow: window,
+			Grouping:   "25 seconds",
+			Limit:      allTimeLimitForSpan(TimeRange(window.Span)),
+			Order:      "DESC",
+		}, db)
+		if err != nil {
+			return nil, err
+		}
+
+		clipIDs := make([]string, 0, len(clips.Body))
+		for _, clip := range clips.Body {
+			clipIDs = append(clipIDs, clip.ClipID)
+		}
+
+		var fetched []FetchedClip
+		err = db.Where("clip_id IN ?", clipIDs).Find(&fetched).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for index, clip := range clips.Body {
+			topClip := TopClip{
+				ClipID:  clip.ClipID,
+				EmoteID: emote.EmoteID,
+				Rank:    index + 1,
+				Count:   clip.Count,
+				Span:    TimeRange(window.Span),
+				Emote:   Emote{Code: emote.Code, Url: emote.EmoteURL},
+			}
+
+			for _, fetchedClip := range fetched {
+				if fetchedClip.ClipID == clip.ClipID {
+					topClip.Clip = fetchedClip
+				}
+			}
+
+			results = append(results, topClip)
+		}
+	}
+
+	return results, nil
 }
 
 func storedTopClips(span TimeRange, emoteIds []int, db *gorm.DB) ([]TopClip, error) {
@@ -474,6 +699,7 @@ func initializeTopClips(db *gorm.DB) error {
 		fmt.Println("====")
 		err = initializeTopClipsStore(span, emotesToInit, db)
 	}
+	responses.invalidateScope(scopeTopClips)
 	return nil
 }
 
@@ -481,29 +707,6 @@ func emoteSpanKey(emoteID int, span TimeRange) string {
 	return fmt.Sprintf("%d-%s", emoteID, span)
 }
 
-func timeStringToDuration(timeString TimeRange) (time.Duration, error) {
-	switch timeString {
-	case "1 minute":
-		return time.Minute, nil
-	case "30 minutes":
-		return 30 * time.Minute, nil
-	case "1 hour":
-		return time.Hour, nil
-	case "9 hours":
-		return 9 * time.Hour, nil
-	case "1 week":
-		return 7 * 24 * time.Hour, nil
-	case "1 month":
-		return 30 * 24 * time.Hour, nil
-	case "1 year":
-		return 365 * 24 * time.Hour, nil
-	case "all":
-		return 0, nil
-	default:
-		return 0, fmt.Errorf("invalid time span, %s", timeString)
-	}
-}
-
 func refreshTopClipsCache(db *gorm.DB) error {
 
 	emoteMap, err := getEmotesInDB(db)
@@ -526,7 +729,7 @@ func refreshTopClipsCache(db *gorm.DB) error {
 	// this should be more efficient than recomputing the entire rankings every time Nl logs off.
 	dailyResults, err := topClips("9 hours", emotesToRefresh, db)
 	if err != nil {
-		return fmt.Errorf("error fetching daily clips", err)
+		return fmt.Errorf("error fetching daily clips: %w", err)
 	}
 	emoteSpanToClips := make(map[string][]Clip)
 	for result := range dailyResults {
@@ -543,12 +746,12 @@ func refreshTopClipsCache(db *gorm.DB) error {
 
 		storedTopForSpan, err := storedTopClips(span, emoteIds, db)
 		if err != nil {
-			return fmt.Errorf("error fetching stored top clips", err)
+			return fmt.Errorf("error fetching stored top clips: %w", err)
 		}
 
-		duration, err := timeStringToDuration(span)
+		duration, err := spanDuration(string(span))
 		if err != nil {
-			return fmt.Errorf("error converting time span to duration", err)
+			return fmt.Errorf("error converting time span to duration: %w", err)
 		}
 		lowerTimeLimit := time.Now().Add(-duration)
 		fmt.Println("time limt: ", lowerTimeLimit)
@@ -587,7 +790,7 @@ func refreshTopClipsCache(db *gorm.DB) error {
 		splitText := strings.Split(emoteSpan, "-")
 		emoteID, err := strconv.Atoi(splitText[0])
 		if err != nil {
-			return fmt.Errorf("error converting emote id to int", err)
+			return fmt.Errorf("error converting emote id to int: %w", err)
 		}
 		span := splitText[1]
 		limitForSpan := allTimeLimitForSpan(TimeRange(span))
@@ -622,7 +825,8 @@ func refreshTopClipsCache(db *gorm.DB) error {
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("error refreshing top clips", err)
+		return fmt.Errorf("error refreshing top clips: %w", err)
 	}
+	responses.invalidateScope(scopeTopClips)
 	return nil
 }
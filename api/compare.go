@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+type CompareInput struct {
+	Streams  []int     `query:"streams"`
+	FromA    time.Time `query:"from_a"`
+	ToA      time.Time `query:"to_a"`
+	FromB    time.Time `query:"from_b"`
+	ToB      time.Time `query:"to_b"`
+	EmoteIDs []int     `query:"emote_ids"`
+	Grouping string    `query:"grouping" enum:"second,minute,hour" default:"minute"`
+}
+
+// one side of a comparison: either a stream session or an arbitrary range
+type CompareWindow struct {
+	Label string `json:"label"`
+	ResolvedWindow
+}
+
+type ComparePoint struct {
+	Minute float64 `json:"minute"`
+	// one entry per window, in the same order as Windows
+	Series []map[string]float64 `json:"series"`
+}
+
+type CompareTotal struct {
+	EmoteID int    `json:"emote_id"`
+	Code    string `json:"code"`
+	// one entry per window, in the same order as Windows
+	Sums []int `json:"sums"`
+	// each window against the first
+	Deltas        []int     `json:"deltas"`
+	PercentDeltas []float64 `json:"percent_deltas"`
+	HexColor      string    `json:"hex_color"`
+	EmoteURL      string    `json:"emote_url"`
+}
+
+type CompareReport struct {
+	Windows    []CompareWindow  `json:"windows"`
+	Series     []ComparePoint   `json:"series"`
+	Totals     []CompareTotal   `json:"totals"`
+	TopMoments [][]StreamMoment `json:"top_moments"`
+}
+
+type CompareOutput struct {
+	Body CompareReport
+}
+
+func compareWindows(p CompareInput, db *gorm.DB) ([]CompareWindow, error) {
+	if len(p.Streams) > 0 {
+		if len(p.Streams) < 2 {
+			return nil, huma.Error422UnprocessableEntity("need at least two streams to compare")
+		}
+
+		windows := make([]CompareWindow, 0, len(p.Streams))
+
+		for _, streamID := range p.Streams {
+			var stream StreamSession
+
+			err := db.First(&stream, streamID).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, huma.Error404NotFound(fmt.Sprintf("no stream with id %d", streamID))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error fetching stream %d: %w", streamID, err)
+			}
+
+			to := time.Now()
+			if stream.EndedAt != nil {
+				to = *stream.EndedAt
+			}
+
+			windows = append(windows, CompareWindow{
+				Label:          fmt.Sprintf("%s %s", stream.StartedAt.Format("2006-01-02"), stream.Title),
+				ResolvedWindow: ResolvedWindow{From: stream.StartedAt, To: to, StreamID: streamID},
+			})
+		}
+
+		return windows, nil
+	}
+
+	if p.FromA.IsZero() || p.ToA.IsZero() || p.FromB.IsZero() || p.ToB.IsZero() {
+		return nil, huma.Error422UnprocessableEntity("either streams or from_a, to_a, from_b and to_b are required")
+	}
+
+	if !p.ToA.After(p.FromA) || !p.ToB.After(p.FromB) {
+		return nil, huma.Error422UnprocessableEntity("to_a and to_b have to come after from_a and from_b")
+	}
+
+	return []CompareWindow{
+		{Label: "a", ResolvedWindow: ResolvedWindow{From: p.FromA, To: p.ToA}},
+		{Label: "b", ResolvedWindow: ResolvedWindow{From: p.FromB, To: p.ToB}},
+	}, nil
+}
+
+func selectCompare(p CompareInput, db *gorm.DB) (*CompareOutput, error) {
+	windows, err := compareWindows(p, db)
+	if err != nil {
+		return &CompareOutput{}, err
+	}
+
+	if len(p.EmoteIDs) == 0 {
+		// compare whatever chat was most into during the first window
+		p.EmoteIDs, err = topEmoteIds(db, EmoteSumInput{
+			TimeWindow: windows[0].input(),
+			Grouping:   p.Grouping,
+			Limit:      5,
+		})
+		if err != nil {
+			return &CompareOutput{}, err
+		}
+	}
+
+	report := CompareReport{
+		Windows:    windows,
+		TopMoments: make([][]StreamMoment, len(windows)),
+	}
+
+	groupingMinutes := map[string]float64{"second": 1.0 / 6, "minute": 1, "hour": 60}[p.Grouping]
+
+	// minute offset -> one series map per window
+	aligned := make(map[float64][]map[string]float64)
+	totals := make(map[int]*CompareTotal)
+
+	for i, window := range windows {
+		series := baseSeriesSelect(SeriesInputForEmotes{
+			Grouping: p.Grouping,
+			EmoteIDs: p.EmoteIDs,
+		}, window.ResolvedWindow)
+
+		sql, args, err := series.ToSql()
+		if err != nil {
+			return &CompareOutput{}, err
+		}
+
+		var rows []TimeSeriesRow
+
+		err = db.Raw(sql, args...).Scan(&rows).Error
+		if err != nil {
+			fmt.Println("error fetching compare series", err)
+			return &CompareOutput{}, err
+		}
+
+		for _, row := range rows {
+			// windows rarely start on a bucket boundary, so snap offsets to the grouping to line them up
+			minute := math.Floor(max(row.Bucket.Sub(window.From).Minutes(), 0)/groupingMinutes) * groupingMinutes
+
+			if _, ok := aligned[minute]; !ok {
+				aligned[minute] = make([]map[string]float64, len(windows))
+			}
+
+			if aligned[minute][i] == nil {
+				aligned[minute][i] = make(map[string]float64)
+			}
+
+			aligned[minute][i][row.Code] += row.Sum
+		}
+
+		sums, err := selectSums(db, EmoteSumInput{
+			TimeWindow: window.input(),
+			Grouping:   p.Grouping,
+			Limit:      1000,
+		})
+		if err != nil {
+			return &CompareOutput{}, err
+		}
+
+		for _, emoteSum := range sums.Body.Emotes {
+			if !slices.Contains(p.EmoteIDs, emoteSum.EmoteID) {
+				continue
+			}
+
+			if _, ok := totals[emoteSum.EmoteID]; !ok {
+				totals[emoteSum.EmoteID] = &CompareTotal{
+					EmoteID:  emoteSum.EmoteID,
+					Code:     emoteSum.Code,
+					HexColor: emoteSum.HexColor,
+					EmoteURL: emoteSum.EmoteURL,
+					Sums:     make([]int, len(windows)),
+				}
+			}
+
+			totals[emoteSum.EmoteID].Sums[i] = emoteSum.Sum
+		}
+
+		report.TopMoments[i], err = topMoments(func(query sq.SelectBuilder) sq.SelectBuilder {
+			return window.where(query, "created_at")
+		}, db)
+		if err != nil {
+			return &CompareOutput{}, err
+		}
+	}
+
+	report.Series = make([]ComparePoint, 0, len(aligned))
+
+	for minute, series := range aligned {
+		report.Series = append(report.Series, ComparePoint{Minute: minute, Series: series})
+	}
+
+	slices.SortFunc(report.Series, func(i, j ComparePoint) int {
+		if i.Minute < j.Minute {
+			return -1
+		}
+		if i.Minute > j.Minute {
+			return 1
+		}
+		return 0
+	})
+
+	report.Totals = make([]CompareTotal, 0, len(totals))
+
+	for _, total := range totals {
+		total.Deltas = make([]int, len(windows))
+		total.PercentDeltas = make([]float64, len(windows))
+
+		for i, sum := range total.Sums {
+			total.Deltas[i] = sum - total.Sums[0]
+
+			if total.Sums[0] != 0 {
+				total.PercentDeltas[i] = float64(total.Deltas[i]) / float64(total.Sums[0]) * 100
+			}
+		}
+
+		report.Totals = append(report.Totals, *total)
+	}
+
+	slices.SortFunc(report.Totals, func(i, j CompareTotal) int {
+		return slices.Max(j.Sums) - slices.Max(i.Sums)
+	})
+
+	return &CompareOutput{Body: report}, nil
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// a named metric derived from emote counts, eg "hype" = #12 + #15 - #3, or
+// "laugh ratio" = (#1 + #7) / messages. evaluated in sql wherever a series or
+// rolling sum is built, so it works at any grouping without storing anything new.
+//
+// expressions are made of numbers, emote ids written as #id, the baselines below,
+// + - * /, and parentheses. dividing by zero gives no value for that bucket.
+type CompositeIndex struct {
+	gorm.Model
+	Name       string `gorm:"unique" json:"name"`
+	Expression string `json:"expression"`
+}
+
+const (
+	// chat messages in the bucket, whether or not they had a tracked emote
+	baselineMessages = "messages"
+	// every tracked emote used in the bucket, except two
+	baselineEmotes = "emotes"
+)
+
+const (
+	maxCompositeExpressionLength = 500
+	maxCompositeReferences       = 20
+)
+
+type compositeNode struct {
+	// one of number, emote, baseline, neg, +, -, *, /
+	kind     string
+	value    float64
+	emoteID  int
+	baseline string
+	left     *compositeNode
+	right    *compositeNode
+}
+
+type compositeParser struct {
+	expression string
+	position   int
+}
+
+func parseComposite(expression string) (*compositeNode, error) {
+	if len(expression) > maxCompositeExpressionLength {
+		return nil, fmt.Errorf("expression is longer than %d characters", maxCompositeExpressionLength)
+	}
+
+	parser := &compositeParser{expression: expression}
+
+	node, err := parser.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	parser.skipSpaces()
+	if parser.position < len(parser.expression) {
+		return nil, fmt.Errorf("unexpected %q at position %d", parser.expression[parser.position], parser.position)
+	}
+
+	// a bucket only exists when some emote was used in it
+	if len(node.emoteIDs()) == 0 && !node.usesBaseline(baselineEmotes) {
+		return nil, fmt.Errorf("expression must use at least one emote or the emotes baseline")
+	}
+
+	if len(node.references()) > maxCompositeReferences {
+		return nil, fmt.Errorf("expression uses more than %d emotes and baselines", maxCompositeReferences)
+	}
+
+	return node, nil
+}
+
+func (p *compositeParser) skipSpaces() {
+	for p.position < len(p.expression) && p.expression[p.position] == ' ' {
+		p.position++
+	}
+}
+
+func (p *compositeParser) peek() byte {
+	p.skipSpaces()
+	if p.position >= len(p.expression) {
+		return 0
+	}
+	return p.expression[p.position]
+}
+
+func (p *compositeParser) parseSum() (*compositeNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == '+' || p.peek() == '-' {
+		op := string(p.expression[p.position])
+		p.position++
+
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &compositeNode{kind: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *compositeParser) parseProduct() (*compositeNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == '*' || p.peek() == '/' {
+		op := string(p.expression[p.position])
+		p.position++
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &compositeNode{kind: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *compositeParser) parseUnary() (*compositeNode, error) {
+	if p.peek() == '-' {
+		p.position++
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &compositeNode{kind: "neg", left: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *compositeParser) parsePrimary() (*compositeNode, error) {
+	next := p.peek()
+	start := p.position
+
+	switch {
+	case next == 0:
+		return nil, fmt.Errorf("expression ended early")
+
+	case next == '(':
+		p.position++
+
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) for ( at position %d", start)
+		}
+		p.position++
+
+		return node, nil
+
+	case next == '#':
+		p.position++
+		digits := p.takeWhile(func(c byte) bool { return c >= '0' && c <= '9' })
+
+		emoteID, err := strconv.Atoi(digits)
+		if err != nil {
+			return nil, fmt.Errorf("expected an emote id after # at position %d", start)
+		}
+
+		return &compositeNode{kind: "emote", emoteID: emoteID}, nil
+
+	case next >= '0' && next <= '9' || next == '.':
+		number := p.takeWhile(func(c byte) bool { return c >= '0' && c <= '9' || c == '.' })
+
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", number, start)
+		}
+
+		return &compositeNode{kind: "number", value: value}, nil
+
+	case next >= 'a' && next <= 'z' || next >= 'A' && next <= 'Z':
+		name := p.takeWhile(func(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' })
+
+		switch name {
+		case baselineMessages, baselineEmotes:
+			return &compositeNode{kind: "baseline", baseline: name}, nil
+		default:
+			return nil, fmt.Errorf("unknown name %q at position %d, emotes are referenced by id, eg #12", name, start)
+		}
+
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", next, start)
+	}
+}
+
+func (p *compositeParser) takeWhile(accept func(c byte) bool) string {
+	start := p.position
+	for p.position < len(p.expression) && accept(p.expression[p.position]) {
+		p.position++
+	}
+	return p.expression[start:p.position]
+}
+
+// the columns the expression reads, eg emote_12 or messages, each listed once
+func (n *compositeNode) references() []string {
+	if n == nil {
+		return nil
+	}
+
+	switch n.kind {
+	case "emote":
+		return []string{fmt.Sprintf("emote_%d", n.emoteID)}
+	case "baseline":
+		return []string{n.baseline}
+	case "number":
+		return nil
+	}
+
+	references := n.left.references()
+	for _, reference := range n.right.references() {
+		if !slices.Contains(references, reference) {
+			references = append(references, reference)
+		}
+	}
+
+	return references
+}
+
+func (n *compositeNode) emoteIDs() []int {
+	if n == nil {
+		return nil
+	}
+
+	if n.kind == "emote" {
+		return []int{n.emoteID}
+	}
+
+	ids := n.left.emoteIDs()
+	for _, id := range n.right.emoteIDs() {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// the emote ids as a sql list, eg 12, 15, 3
+func (n *compositeNode) emoteIDList() string {
+	ids := make([]string, 0)
+	for _, emoteID := range n.emoteIDs() {
+		ids = append(ids, strconv.Itoa(emoteID))
+	}
+	return strings.Join(ids, ", ")
+}
+
+func (n *compositeNode) usesBaseline(baseline string) bool {
+	return slices.Contains(n.references(), baseline)
+}
+
+// renders the expression as sql. column maps a reference to the sql that reads
+// it, so the same expression can be evaluated per bucket or over a window.
+// everything inlined is a parsed number, so there is nothing to escape. references
+// are cast to float so a ratio of counts isn't integer division.
+func (n *compositeNode) sql(column func(reference string) string) string {
+	switch n.kind {
+	case "number":
+		return strconv.FormatFloat(n.value, 'f', -1, 64)
+	case "emote":
+		return fmt.Sprintf("(%s)::float", column(fmt.Sprintf("emote_%d", n.emoteID)))
+	case "baseline":
+		return fmt.Sprintf("(%s)::float", column(n.baseline))
+	case "neg":
+		return fmt.Sprintf("(-%s)", n.left.sql(column))
+	case "/":
+		return fmt.Sprintf("(%s / NULLIF(%s, 0))", n.left.sql(column), n.right.sql(column))
+	default:
+		return fmt.Sprintf("(%s %s %s)", n.left.sql(column), n.kind, n.right.sql(column))
+	}
+}
+
+// per bucket (or per 10 second row for emote_counts) totals for each emote the
+// expression reads, plus the emotes baseline when it's used
+func compositeComponents(node *compositeNode, sumColumn string, bucketColumn string) []string {
+	columns := []string{bucketColumn}
+
+	for _, emoteID := range node.emoteIDs() {
+		columns = append(columns, fmt.Sprintf("COALESCE(SUM(%s) FILTER (WHERE emote_id = %d), 0) as emote_%d", sumColumn, emoteID, emoteID))
+	}
+
+	if node.usesBaseline(baselineEmotes) {
+		columns = append(columns, fmt.Sprintf("COALESCE(SUM(%s) FILTER (WHERE emote_id NOT IN (SELECT id FROM emotes WHERE code = 'two')), 0) as emotes", sumColumn))
+	}
+
+	return columns
+}
+
+func loadComposites(ids []int, db *gorm.DB) ([]CompositeIndex, error) {
+	composites := []CompositeIndex{}
+
+	ids = slices.Clone(ids)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	err := db.Where("id IN ?", ids).Find(&composites).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(composites) != len(ids) {
+		return nil, huma.Error404NotFound("no composite index for some of those ids")
+	}
+
+	return composites, nil
+}
+
+// one series per composite, shaped like baseSeriesSelect so it can be unioned onto it.
+// emote_id is the negated composite id so rolling windows keep each series apart.
+//
+// each select is rendered with ? placeholders and only the outer query numbers them.
+// a nested builder rendering its own $1.. would restart the count and bind the wrong args.
+func unionCompositeSeries(composites []CompositeIndex, p SeriesInputForEmotes, window ResolvedWindow) (sq.Sqlizer, error) {
+	parts := make([]string, 0, len(composites))
+	args := make([]any, 0)
+
+	for _, composite := range composites {
+		node, err := parseComposite(composite.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("composite %s no longer parses: %w", composite.Name, err)
+		}
+
+		components := statementBuilder().
+			Select(compositeComponents(node, "sum", "bucket")...).
+			From(groupingToView[p.Grouping]).
+			GroupBy("bucket")
+
+		components = filterSeries(components, p, window)
+
+		if !node.usesBaseline(baselineEmotes) {
+			components = components.Where(sq.Eq{"emote_id": node.emoteIDs()})
+		}
+
+		series := statementBuilder().
+			Select(node.sql(func(reference string) string { return reference })+" as sum", "bucket").
+			Column(sq.Expr("CAST(? AS text) as code", composite.Name)).
+			Column(fmt.Sprintf("%d as emote_id", -int(composite.ID))).
+			FromSelect(components, "components")
+
+		if node.usesBaseline(baselineMessages) {
+			series = series.JoinClause(fmt.Sprintf(`LEFT JOIN LATERAL (
+				SELECT COALESCE(SUM(count), 0) as messages
+				FROM message_counts
+				WHERE created_at >= components.bucket
+				AND created_at < components.bucket + interval '%s'
+			) message_totals ON true`, groupingToBucketWidth[p.Grouping]))
+		}
+
+		// a composite that divides by zero has no value for that bucket
+		sql, compositeArgs, err := statementBuilder().
+			Select("sum", "bucket", "code", "emote_id").
+			FromSelect(series, "composite").
+			Where("sum IS NOT NULL").
+			PlaceholderFormat(sq.Question).
+			ToSql()
+		if err != nil {
+			return nil, err
+		}
+
+		parts = append(parts, "UNION ALL "+sql)
+		args = append(args, compositeArgs...)
+	}
+
+	return sq.Expr(strings.Join(parts, " "), args...), nil
+}
+
+// the rolling sum of a composite over emote_counts, shaped like the rolling sum
+// selectClipsFromEmotePeaks builds for a single emote. each component is summed over
+// the window before the expression is applied, so ratios stay ratios of totals.
+func compositeRollingSum(node *compositeNode, window string, filters string) string {
+	emoteFilter := "true"
+	if !node.usesBaseline(baselineEmotes) {
+		emoteFilter = fmt.Sprintf("emote_id IN (%s)", node.emoteIDList())
+	}
+
+	components := fmt.Sprintf(`
+		SELECT %s
+		FROM emote_counts
+		WHERE %s %s
+		GROUP BY created_at`,
+		strings.Join(compositeComponents(node, "count", "created_at"), ", "),
+		emoteFilter,
+		filters)
+
+	// message counts are written when the bucket closes, just before the emote counts
+	// wait on their clip, so the message row for a bucket lands in the 10 seconds before it
+	messagesJoin := ""
+	if node.usesBaseline(baselineMessages) {
+		messagesJoin = `
+		LEFT JOIN LATERAL (
+			SELECT COALESCE(SUM(count), 0) as messages
+			FROM message_counts
+			WHERE message_counts.created_at > components.created_at - interval '10 seconds'
+			AND message_counts.created_at <= components.created_at
+		) message_totals ON true`
+	}
+
+	rollingSum := node.sql(func(reference string) string {
+		return fmt.Sprintf("SUM(%s) OVER rolling_window", reference)
+	})
+
+	return fmt.Sprintf(`
+	SELECT created_at, rolling_sum FROM (
+		SELECT created_at, %s AS rolling_sum
+		FROM (%s) components
+		%s
+		WINDOW rolling_window AS (
+			ORDER BY created_at
+			RANGE BETWEEN INTERVAL '%s' PRECEDING AND CURRENT ROW
+		)
+	) composite
+	WHERE rolling_sum IS NOT NULL
+	`, rollingSum, components, messagesJoin, window)
+}
+
+type CompositeInput struct {
+	Body struct {
+		Name       string `json:"name" minLength:"1" maxLength:"50"`
+		Expression string `json:"expression" minLength:"1"`
+	}
+}
+
+type CompositeOutput struct {
+	Body CompositeIndex
+}
+
+type CompositesOutput struct {
+	Body []CompositeIndex
+}
+
+type DeleteCompositeInput struct {
+	ID int `path:"id"`
+}
+
+func createComposite(input *CompositeInput, db *gorm.DB) (*CompositeOutput, error) {
+	node, err := parseComposite(input.Body.Expression)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity(err.Error())
+	}
+
+	emoteIDs := node.emoteIDs()
+	if len(emoteIDs) > 0 {
+		var found int64
+
+		err = db.Model(&Emote{}).Where("id IN ?", emoteIDs).Count(&found).Error
+		if err != nil {
+			return nil, err
+		}
+
+		if int(found) != len(emoteIDs) {
+			return nil, huma.Error422UnprocessableEntity("expression references an emote id we don't track")
+		}
+	}
+
+	var existing int64
+
+	err = db.Model(&CompositeIndex{}).Where("name = ?", input.Body.Name).Count(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if existing > 0 {
+		return nil, huma.Error409Conflict(fmt.Sprintf("%s already exists", input.Body.Name))
+	}
+
+	composite := CompositeIndex{
+		Name:       input.Body.Name,
+		Expression: input.Body.Expression,
+	}
+
+	err = db.Create(&composite).Error
+	if err != nil {
+		fmt.Println("error creating composite index", err)
+		return nil, err
+	}
+
+	return &CompositeOutput{Body: composite}, nil
+}
+
+func selectComposites(db *gorm.DB) (*CompositesOutput, error) {
+	composites := []CompositeIndex{}
+
+	err := db.Order("name").Find(&composites).Error
+	if err != nil {
+		return &CompositesOutput{}, err
+	}
+
+	return &CompositesOutput{Body: composites}, nil
+}
+
+func deleteComposite(input *DeleteCompositeInput, db *gorm.DB) (*struct{}, error) {
+	result := db.Delete(&CompositeIndex{}, input.ID)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, huma.Error404NotFound("no composite index with that id")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestSeriesQueryNumbersCompositePlaceholdersOnce(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(9 * time.Hour)
+
+	p := SeriesInputForEmotes{EmoteIDs: []int{1, 2}}
+	p.Grouping = "hour"
+
+	composites := []CompositeIndex{
+		{Model: gorm.Model{ID: 3}, Name: "hype", Expression: "#1 + #4"},
+		{Model: gorm.Model{ID: 5}, Name: "ratio", Expression: "#7 / messages"},
+	}
+
+	query, err := seriesQuery(p, ResolvedWindow{From: from, To: to}, seriesOptions{grouping: "hour", rolling: "PT1H", smoothing: "avg"}, composites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placeholders := regexp.MustCompile(`\$(\d+)`).FindAllStringSubmatch(sql, -1)
+
+	if len(placeholders) != len(args) {
+		t.Fatalf("%d placeholders for %d args in %s", len(placeholders), len(args), sql)
+	}
+
+	for i, placeholder := range placeholders {
+		if placeholder[1] != strconv.Itoa(i+1) {
+			t.Fatalf("placeholder %d is $%s in %s", i+1, placeholder[1], sql)
+		}
+	}
+
+	// each composite's name is bound where its code is cast
+	casts := regexp.MustCompile(`CAST\(\$(\d+) AS text\)`).FindAllStringSubmatch(sql, -1)
+	if len(casts) != len(composites) {
+		t.Fatalf("expected %d code casts in %s", len(composites), sql)
+	}
+
+	for i, cast := range casts {
+		position, _ := strconv.Atoi(cast[1])
+		if got := fmt.Sprint(args[position-1]); got != composites[i].Name {
+			t.Errorf("$%d binds %q, want %q", position, got, composites[i].Name)
+		}
+	}
+}
@@ -19,6 +19,7 @@ type AppConfig struct {
 	DatabaseUrl  string
 	Debug        bool
 	S3Bucket     string
+	Timezone     string
 }
 
 func LoadConfig() {
@@ -31,6 +32,11 @@ func LoadConfig() {
 			DatabaseUrl:  os.Getenv("DATABASE_URL"),
 			Debug:        os.Getenv("DEBUG") == "true",
 			S3Bucket:     os.Getenv("AWS_S3_BUCKET"),
+			Timezone:     os.Getenv("CHANNEL_TIMEZONE"),
+		}
+
+		if instance.Timezone == "" {
+			instance.Timezone = "America/New_York"
 		}
 	})
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+// how many times two tracked emotes showed up in the same message during a 10 second
+// bucket. EmoteAID is always the smaller id.
+type EmotePairCount struct {
+	Id        int64
+	EmoteAID  int `gorm:"column:emote_a_id;index"`
+	EmoteBID  int `gorm:"column:emote_b_id;index"`
+	Count     int
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// every chat message in a 10 second bucket, whether or not it had a tracked emote.
+// the denominator for lift and any per-message rate.
+type MessageCount struct {
+	Id        int64
+	Count     int
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// only the busiest pairs of each bucket are kept, so memory and rows stay bounded
+// however many emotes we track. pair counts are therefore a lower bound.
+const topPairsPerBucket = 50
+
+type emotePair struct {
+	a int
+	b int
+}
+
+type CooccurrenceCounter struct {
+	pairs    map[emotePair]int
+	messages int
+}
+
+func newCooccurrenceCounter() *CooccurrenceCounter {
+	return &CooccurrenceCounter{pairs: make(map[emotePair]int)}
+}
+
+func (c *CooccurrenceCounter) countMessage(emoteIDs []int) {
+	c.messages++
+
+	for i := 0; i < len(emoteIDs); i++ {
+		for j := i + 1; j < len(emoteIDs); j++ {
+			pair := emotePair{a: min(emoteIDs[i], emoteIDs[j]), b: max(emoteIDs[i], emoteIDs[j])}
+			c.pairs[pair]++
+		}
+	}
+}
+
+// returns the bucket's top pairs and message count, then starts a new bucket
+func (c *CooccurrenceCounter) flush(at time.Time) ([]EmotePairCount, MessageCount) {
+	pairCounts := make([]EmotePairCount, 0, len(c.pairs))
+
+	for pair, count := range c.pairs {
+		pairCounts = append(pairCounts, EmotePairCount{
+			EmoteAID:  pair.a,
+			EmoteBID:  pair.b,
+			Count:     count,
+			CreatedAt: at,
+		})
+	}
+
+	slices.SortFunc(pairCounts, func(i, j EmotePairCount) int {
+		return j.Count - i.Count
+	})
+
+	if len(pairCounts) > topPairsPerBucket {
+		pairCounts = pairCounts[:topPairsPerBucket]
+	}
+
+	messages := MessageCount{Count: c.messages, CreatedAt: at}
+
+	c.pairs = make(map[emotePair]int)
+	c.messages = 0
+
+	return pairCounts, messages
+}
+
+func persistCooccurrenceIfLive(db *gorm.DB, pairCounts []EmotePairCount, messages MessageCount, liveStatus *LiveStatus) {
+	if isLive, _ := liveStatus.current(); !isLive {
+		return
+	}
+
+	err := db.Create(&messages).Error
+	if err != nil {
+		fmt.Println("Error inserting message count:", err)
+	}
+
+	if len(pairCounts) == 0 {
+		return
+	}
+
+	err = db.Create(&pairCounts).Error
+	if err != nil {
+		fmt.Println("Error inserting emote pair counts:", err)
+	}
+}
+
+type CooccurrenceInput struct {
+	TimeWindow
+	EmoteIDs []int  `query:"emote_ids"`
+	OrderBy  string `query:"order_by" enum:"lift,count" default:"lift"`
+	MinCount int    `query:"min_count" default:"10" minimum:"1"`
+	Limit    int    `query:"limit" default:"20" minimum:"1" maximum:"500"`
+}
+
+type CooccurrencePair struct {
+	EmoteAID int    `gorm:"column:emote_a_id" json:"emote_a_id"`
+	CodeA    string `json:"code_a"`
+	EmoteBID int    `gorm:"column:emote_b_id" json:"emote_b_id"`
+	CodeB    string `json:"code_b"`
+	Count    int    `json:"count"`
+	// how much more often the pair shares a message than if the two were independent
+	Lift float64 `json:"lift"`
+}
+
+type CooccurrenceOutput struct {
+	Body []CooccurrencePair
+}
+
+const defaultCooccurrenceDuration = "P1W"
+
+func selectCooccurrence(p CooccurrenceInput, db *gorm.DB) (*CooccurrenceOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultCooccurrenceDuration)
+	if err != nil {
+		return &CooccurrenceOutput{}, err
+	}
+
+	pairs := statementBuilder().
+		Select("emote_a_id", "emote_b_id", "SUM(count) as count").
+		From("emote_pair_counts").
+		GroupBy("emote_a_id", "emote_b_id").
+		Having(sq.GtOrEq{"SUM(count)": p.MinCount})
+
+	pairs = window.where(pairs, "created_at")
+
+	if len(p.EmoteIDs) > 0 {
+		pairs = pairs.Where(sq.Or{
+			sq.Eq{"emote_a_id": p.EmoteIDs},
+			sq.Eq{"emote_b_id": p.EmoteIDs},
+		})
+	}
+
+	messages := statementBuilder().
+		Select("SUM(count) as total").
+		From("message_counts")
+
+	messages = window.where(messages, "created_at")
+
+	// emote counts are counts of messages containing the emote, which is what lift needs
+	singles := statementBuilder().
+		Select("emote_id", "SUM(sum) as count").
+		From(secondViewAggregate).
+		GroupBy("emote_id")
+
+	singles = window.where(singles, "bucket")
+
+	orderBy := "lift DESC"
+	if p.OrderBy == "count" {
+		orderBy = "count DESC"
+	}
+
+	query, args, err := statementBuilder().
+		Select(
+			"pairs.emote_a_id",
+			"a.code as code_a",
+			"pairs.emote_b_id",
+			"b.code as code_b",
+			"pairs.count",
+			"COALESCE(pairs.count::float * messages.total / NULLIF(single_a.count::float * single_b.count, 0), 0) as lift").
+		FromSelect(pairs, "pairs").
+		JoinClause(messages.Prefix("CROSS JOIN (").Suffix(") messages")).
+		JoinClause(singles.Prefix("JOIN (").Suffix(") single_a ON single_a.emote_id = pairs.emote_a_id")).
+		JoinClause(singles.Prefix("JOIN (").Suffix(") single_b ON single_b.emote_id = pairs.emote_b_id")).
+		Join("emotes a on a.id = pairs.emote_a_id").
+		Join("emotes b on b.id = pairs.emote_b_id").
+		OrderBy(orderBy).
+		Limit(uint64(p.Limit)).
+		ToSql()
+	if err != nil {
+		return &CooccurrenceOutput{}, err
+	}
+
+	result := []CooccurrencePair{}
+
+	err = db.Raw(query, args...).Scan(&result).Error
+	if err != nil {
+		fmt.Println("error fetching cooccurrence", err)
+		return &CooccurrenceOutput{}, err
+	}
+
+	return &CooccurrenceOutput{Body: result}, nil
+}
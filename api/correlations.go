@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+type EmoteCorrelationInput struct {
+	TimeWindow
+	Grouping string `query:"grouping" enum:"second,minute,hour,day" default:"hour"`
+	EmoteIDs []int  `query:"emote_ids"`
+	// compare each emote against the others this many buckets later
+	Lag   int `query:"lag" default:"0" minimum:"0" maximum:"100"`
+	Pairs int `query:"pairs" default:"10" minimum:"1" maximum:"100"`
+}
+
+type CorrelationEmote struct {
+	EmoteID int    `json:"emote_id"`
+	Code    string `json:"code"`
+}
+
+type EmoteCorrelationPair struct {
+	A        CorrelationEmote `json:"a"`
+	B        CorrelationEmote `json:"b"`
+	Pearson  float64          `json:"pearson"`
+	Spearman float64          `json:"spearman"`
+}
+
+type EmoteCorrelationReport struct {
+	Emotes []CorrelationEmote `json:"emotes"`
+	// Pearson[i][j] correlates Emotes[i] with Emotes[j], lagged by Input.Lag buckets
+	Pearson        [][]float64            `json:"pearson"`
+	Spearman       [][]float64            `json:"spearman"`
+	StrongestPairs []EmoteCorrelationPair `json:"strongest_pairs"`
+	Buckets        int                    `json:"buckets"`
+	Input          EmoteCorrelationInput  `json:"input"`
+	Window         ResolvedWindow         `json:"window"`
+}
+
+type EmoteCorrelationOutput struct {
+	Body EmoteCorrelationReport
+}
+
+// how far back we look when the caller doesn't give us a range
+const defaultCorrelationDuration = "P30D"
+
+func selectEmoteCorrelations(p EmoteCorrelationInput, db *gorm.DB) (*EmoteCorrelationOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultCorrelationDuration)
+	if err != nil {
+		return &EmoteCorrelationOutput{}, err
+	}
+
+	if err := validateGrouping(p.Grouping, window, 0); err != nil {
+		return &EmoteCorrelationOutput{}, err
+	}
+
+	if len(p.EmoteIDs) == 0 {
+		topIDs, err := topEmoteIds(db, EmoteSumInput{
+			TimeWindow: window.input(),
+			Grouping:   p.Grouping,
+			Limit:      10,
+		})
+		if err != nil {
+			return &EmoteCorrelationOutput{}, err
+		}
+		p.EmoteIDs = topIDs
+	}
+
+	seriesQuery := statementBuilder().
+		Select("sum", "bucket", "code", "emote_id").
+		From(groupingToView[p.Grouping]).
+		Join("emotes on emotes.id = emote_id").
+		Where(sq.Eq{"emote_id": p.EmoteIDs})
+
+	query, args, err := window.where(seriesQuery, "bucket", groupingToBucketWidth[p.Grouping]).ToSql()
+	if err != nil {
+		return &EmoteCorrelationOutput{}, err
+	}
+
+	var rows []struct {
+		Sum     float64
+		Bucket  time.Time
+		Code    string
+		EmoteID int
+	}
+
+	err = db.Raw(query, args...).Scan(&rows).Error
+	if err != nil {
+		fmt.Println("error fetching correlation series", err)
+		return &EmoteCorrelationOutput{}, err
+	}
+
+	bucketIndex := make(map[time.Time]int)
+	emoteIndex := make(map[int]int)
+	report := EmoteCorrelationReport{Input: p, Window: window, Emotes: []CorrelationEmote{}, StrongestPairs: []EmoteCorrelationPair{}}
+
+	buckets := make([]time.Time, 0)
+	for _, row := range rows {
+		if _, ok := bucketIndex[row.Bucket]; !ok {
+			bucketIndex[row.Bucket] = 0
+			buckets = append(buckets, row.Bucket)
+		}
+		if _, ok := emoteIndex[row.EmoteID]; !ok {
+			emoteIndex[row.EmoteID] = len(report.Emotes)
+			report.Emotes = append(report.Emotes, CorrelationEmote{EmoteID: row.EmoteID, Code: row.Code})
+		}
+	}
+
+	slices.SortFunc(buckets, func(i, j time.Time) int { return i.Compare(j) })
+	for i, bucket := range buckets {
+		bucketIndex[bucket] = i
+	}
+
+	// a bucket with no row for an emote means nobody used it
+	series := make([][]float64, len(report.Emotes))
+	for i := range series {
+		series[i] = make([]float64, len(buckets))
+	}
+	for _, row := range rows {
+		series[emoteIndex[row.EmoteID]][bucketIndex[row.Bucket]] = row.Sum
+	}
+
+	report.Buckets = len(buckets)
+	report.Pearson = make([][]float64, len(series))
+	report.Spearman = make([][]float64, len(series))
+
+	ranks := make([][]float64, len(series))
+	for i := range series {
+		ranks[i] = fractionalRanks(series[i])
+	}
+
+	for i := range series {
+		report.Pearson[i] = make([]float64, len(series))
+		report.Spearman[i] = make([]float64, len(series))
+
+		for j := range series {
+			leading, lagging := lagged(series[i], series[j], p.Lag)
+			report.Pearson[i][j] = pearson(leading, lagging)
+
+			leadingRanks, laggingRanks := lagged(ranks[i], ranks[j], p.Lag)
+			report.Spearman[i][j] = pearson(leadingRanks, laggingRanks)
+
+			// without a lag the matrix is symmetric, so only count each pair once
+			if i == j || (p.Lag == 0 && j < i) {
+				continue
+			}
+
+			report.StrongestPairs = append(report.StrongestPairs, EmoteCorrelationPair{
+				A:        report.Emotes[i],
+				B:        report.Emotes[j],
+				Pearson:  report.Pearson[i][j],
+				Spearman: report.Spearman[i][j],
+			})
+		}
+	}
+
+	slices.SortFunc(report.StrongestPairs, func(i, j EmoteCorrelationPair) int {
+		if math.Abs(i.Pearson) > math.Abs(j.Pearson) {
+			return -1
+		}
+		if math.Abs(i.Pearson) < math.Abs(j.Pearson) {
+			return 1
+		}
+		return 0
+	})
+
+	if len(report.StrongestPairs) > p.Pairs {
+		report.StrongestPairs = report.StrongestPairs[:p.Pairs]
+	}
+
+	return &EmoteCorrelationOutput{Body: report}, nil
+}
+
+// pairs x[t] with y[t+lag]
+func lagged(x []float64, y []float64, lag int) ([]float64, []float64) {
+	if lag >= len(x) {
+		return nil, nil
+	}
+	return x[:len(x)-lag], y[lag:]
+}
+
+// 0 when either side never changes, rather than NaN, which json can't encode
+func pearson(x []float64, y []float64) float64 {
+	n := float64(len(x))
+	if n < 2 {
+		return 0
+	}
+
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var covariance, varianceX, varianceY float64
+	for i := range x {
+		dx, dy := x[i]-meanX, y[i]-meanY
+		covariance += dx * dy
+		varianceX += dx * dx
+		varianceY += dy * dy
+	}
+
+	if varianceX == 0 || varianceY == 0 {
+		return 0
+	}
+
+	return covariance / math.Sqrt(varianceX*varianceY)
+}
+
+// ranks starting at 1, with ties sharing the average of the ranks they span
+func fractionalRanks(values []float64) []float64 {
+	order := make([]int, len(values))
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortStableFunc(order, func(i, j int) int {
+		if values[i] < values[j] {
+			return -1
+		}
+		if values[i] > values[j] {
+			return 1
+		}
+		return 0
+	})
+
+	ranks := make([]float64, len(values))
+
+	for start := 0; start < len(order); {
+		end := start
+		for end+1 < len(order) && values[order[end+1]] == values[order[start]] {
+			end++
+		}
+
+		rank := float64(start+end)/2 + 1
+		for k := start; k <= end; k++ {
+			ranks[order[k]] = rank
+		}
+
+		start = end + 1
+	}
+
+	return ranks
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+type PreviousStreamDateInput struct {
+	From time.Time `query:"from" doc:"a date, read as a calendar day in the channel's timezone"`
+}
+
+type StreamDateOutput struct {
+	Timezone string `header:"X-Channel-Timezone"`
+	Body     time.Time
+}
+
+// dates are channel-local midnights, so a stream running past midnight utc stays on one day
+func scanStreamDate(db *gorm.DB, query sq.SelectBuilder) (time.Time, error) {
+	var date time.Time
+
+	queryString, args, err := query.ToSql()
+	if err != nil {
+		return date, err
+	}
+
+	err = db.Raw(queryString, args...).Scan(&date).Error
+	if err != nil {
+		return date, err
+	}
+
+	if !date.IsZero() {
+		date = channelDay(date)
+	}
+
+	return date, nil
+}
+
+// the last day with data before from, or before the latest day when from is zero
+func previousStreamDate(db *gorm.DB, from time.Time) (time.Time, error) {
+	psql := statementBuilder()
+	timezone := channelTimezone()
+
+	before := psql.
+		Select().
+		Column("DATE(max(created_at) AT TIME ZONE ?)::timestamp AT TIME ZONE ?", timezone, timezone).
+		From("emote_counts").
+		Prefix("created_at < (").
+		Suffix(")")
+
+	query := psql.
+		Select().
+		Column("DATE(MAX(created_at) AT TIME ZONE ?)", timezone).
+		From("emote_counts")
+
+	if from.IsZero() {
+		query = query.Where(before)
+	} else {
+		query = query.Where(sq.Lt{"created_at": channelDay(from)})
+	}
+
+	return scanStreamDate(db, query)
+}
+
+// the first day with data after from
+func nextStreamDate(db *gorm.DB, from time.Time) (time.Time, error) {
+	query := statementBuilder().
+		Select().
+		Column("DATE(min(created_at) AT TIME ZONE ?)", channelTimezone()).
+		From("emote_counts").
+		Where(sq.GtOrEq{"created_at": channelDay(from).AddDate(0, 0, 1)})
+
+	return scanStreamDate(db, query)
+}
+
+// everything the day page shows, in one round trip
+type DayInput struct {
+	Date time.Time `query:"date" doc:"a date, read as a calendar day in the channel's timezone. the latest day with data when empty"`
+	// whose peaks pick the clips, two by default like /api/clip_counts
+	EmoteID int `query:"emote_id" default:"2"`
+	Limit   int `query:"limit" default:"10" minimum:"1" maximum:"50"`
+}
+
+// a section of the day that loaded, or why it didn't. one failing leaves the rest.
+type DaySection[T any] struct {
+	Data  *T     `json:"data,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type DayBundle struct {
+	Date         time.Time                  `json:"date"`
+	Timezone     string                     `json:"timezone"`
+	Series       DaySection[SeriesPoints]   `json:"series"`
+	Sums         DaySection[EmoteSumReport] `json:"sums"`
+	Growth       DaySection[EmoteReport]    `json:"growth"`
+	Clips        DaySection[[]Clip]         `json:"clips"`
+	PreviousDate DaySection[time.Time]      `json:"previous_date"`
+	NextDate     DaySection[time.Time]      `json:"next_date"`
+}
+
+type DayOutput struct {
+	Body DayBundle
+}
+
+// a slow section shouldn't hold the whole page
+const daySectionTimeout = 15 * time.Second
+
+func loadDaySection[T any](ctx context.Context, wg *sync.WaitGroup, section *DaySection[T], load func(ctx context.Context) (*T, error)) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		defer func() {
+			if r := recover(); r != nil {
+				section.Error = fmt.Sprintf("panicked: %v", r)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(ctx, daySectionTimeout)
+		defer cancel()
+
+		data, err := load(ctx)
+		if err != nil {
+			section.Error = err.Error()
+			return
+		}
+
+		section.Data = data
+	}()
+}
+
+// runs each section in parallel on its own connection. the request's context cancels
+// the lot when the client goes away.
+func selectDay(ctx context.Context, p DayInput, db *gorm.DB) (*DayOutput, error) {
+	day := p.Date
+	if day.IsZero() {
+		latest, err := latestDataTime(db.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		day = latest.In(channelLocation())
+	}
+
+	start := channelDay(day)
+	window := TimeWindow{From: start, To: start.AddDate(0, 0, 1)}
+
+	bundle := DayBundle{Date: start, Timezone: channelTimezone()}
+
+	var wg sync.WaitGroup
+
+	loadDaySection(ctx, &wg, &bundle.Series, func(ctx context.Context) (*SeriesPoints, error) {
+		series, err := selectSeriesForGreatest(SeriesInput{TimeWindow: window, Smoothing: "avg", Downsample: "lttb"}, db.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return &series.Body, nil
+	})
+
+	loadDaySection(ctx, &wg, &bundle.Sums, func(ctx context.Context) (*EmoteSumReport, error) {
+		sums, err := selectSums(db.WithContext(ctx), EmoteSumInput{TimeWindow: window, Limit: p.Limit})
+		if err != nil {
+			return nil, err
+		}
+		return &sums.Body, nil
+	})
+
+	loadDaySection(ctx, &wg, &bundle.Growth, func(ctx context.Context) (*EmoteReport, error) {
+		growth, err := selectPercentGrowthDay(EmotePerformanceInput{
+			Date:     start,
+			Grouping: "day",
+			Limit:    p.Limit,
+			RankBy:   "weighted_percent",
+		}, db.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return &growth.Body, nil
+	})
+
+	loadDaySection(ctx, &wg, &bundle.Clips, func(ctx context.Context) (*[]Clip, error) {
+		clips, err := selectClipsFromEmotePeaks(ClipCountsInput{
+			EmoteID:    p.EmoteID,
+			TimeWindow: window,
+			Grouping:   "1 hour",
+			Order:      "DESC",
+			Limit:      p.Limit,
+		}, db.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return &clips.Body, nil
+	})
+
+	loadDaySection(ctx, &wg, &bundle.PreviousDate, func(ctx context.Context) (*time.Time, error) {
+		date, err := previousStreamDate(db.WithContext(ctx), start)
+		if err != nil || date.IsZero() {
+			return nil, err
+		}
+		return &date, nil
+	})
+
+	loadDaySection(ctx, &wg, &bundle.NextDate, func(ctx context.Context) (*time.Time, error) {
+		date, err := nextStreamDate(db.WithContext(ctx), start)
+		if err != nil || date.IsZero() {
+			return nil, err
+		}
+		return &date, nil
+	})
+
+	wg.Wait()
+
+	return &DayOutput{Body: bundle}, nil
+}
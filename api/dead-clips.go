@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+// a top clip that twitch no longer serves, along with whatever we replaced it with
+type DeadClip struct {
+	gorm.Model
+	ClipID            string    `gorm:"index"`
+	EmoteID           int       `gorm:"index"`
+	Span              TimeRange `gorm:"index"`
+	Rank              int
+	ReplacementClipID string
+}
+
+type DeadClipSpanCount struct {
+	Span     TimeRange `json:"span"`
+	Dead     int       `json:"dead"`
+	Replaced int       `json:"replaced"`
+}
+
+type DeadClipReportOutput struct {
+	Body []DeadClipSpanCount
+}
+
+// helix accepts at most 100 clip ids per request
+const helixClipBatchSize = 100
+
+const deadClipCheckInterval = 6 * time.Hour
+
+func validateTopClipsRegularly(db *gorm.DB, tokenManager *TokenManager) {
+	ticker := time.NewTicker(deadClipCheckInterval)
+	defer ticker.Stop()
+
+	// once on startup, rather than leaving dead clips up until the first tick
+	for {
+		err := validateTopClips(db, tokenManager)
+		if err != nil {
+			fmt.Println("error validating top clips", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+// checks every stored top clip against helix, marks the missing ones as dead,
+// and fills their rank with the next best clip.
+func validateTopClips(db *gorm.DB, tokenManager *TokenManager) error {
+	var clipIDs []string
+
+	// the sentinel stands in for a clip we never made, helix has nothing to say about it
+	err := db.Model(&TopClip{}).Where("clip_id <> ?", noClipSentinel).Distinct("clip_id").Pluck("clip_id", &clipIDs).Error
+	if err != nil {
+		return fmt.Errorf("error fetching top clip ids: %w", err)
+	}
+
+	deadClipIDs := make([]string, 0)
+
+	for start := 0; start < len(clipIDs); start += helixClipBatchSize {
+		end := min(start+helixClipBatchSize, len(clipIDs))
+		batch := clipIDs[start:end]
+
+		liveClips, err := fetchClipsData(batch, tokenManager, db)
+		if err != nil {
+			// if helix is down we can't tell dead from alive, so leave the batch alone
+			fmt.Println("error fetching clip batch from helix", err)
+			continue
+		}
+
+		liveClipIDs := make(map[string]struct{}, len(liveClips))
+		for _, clip := range liveClips {
+			liveClipIDs[clip.ID] = struct{}{}
+		}
+
+		for _, clipID := range batch {
+			if _, ok := liveClipIDs[clipID]; !ok {
+				deadClipIDs = append(deadClipIDs, clipID)
+			}
+		}
+	}
+
+	fmt.Println("dead top clips: ", len(deadClipIDs))
+
+	if len(deadClipIDs) == 0 {
+		return nil
+	}
+
+	err = db.Model(&FetchedClip{}).Where("clip_id IN ?", deadClipIDs).Update("dead", true).Error
+	if err != nil {
+		return fmt.Errorf("error marking clips as dead: %w", err)
+	}
+
+	var deadTopClips []TopClip
+
+	err = db.Where("clip_id IN ?", deadClipIDs).Find(&deadTopClips).Error
+	if err != nil {
+		return fmt.Errorf("error fetching dead top clips: %w", err)
+	}
+
+	for _, deadTopClip := range deadTopClips {
+		err := replaceDeadTopClip(deadTopClip, db)
+		if err != nil {
+			fmt.Println("error replacing dead top clip", deadTopClip.ClipID, err)
+		}
+	}
+
+	responses.invalidateScope(scopeTopClips)
+
+	return nil
+}
+
+func replaceDeadTopClip(deadTopClip TopClip, db *gorm.DB) error {
+	replacement, err := nextBestClipInPeak(deadTopClip, db)
+	if err != nil {
+		return err
+	}
+
+	if replacement == nil {
+		replacement, err = nextBestPeakClip(deadTopClip, db)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(&deadTopClip).Error; err != nil {
+			return fmt.Errorf("error deleting dead top clip: %w", err)
+		}
+
+		deadClip := DeadClip{
+			ClipID:  deadTopClip.ClipID,
+			EmoteID: deadTopClip.EmoteID,
+			Span:    deadTopClip.Span,
+			Rank:    deadTopClip.Rank,
+		}
+
+		if replacement != nil {
+			deadClip.ReplacementClipID = replacement.ClipID
+
+			err := tx.Create(&TopClip{
+				ClipID:  replacement.ClipID,
+				EmoteID: deadTopClip.EmoteID,
+				Rank:    deadTopClip.Rank,
+				Count:   replacement.Count,
+				Span:    deadTopClip.Span,
+			}).Error
+			if err != nil {
+				return fmt.Errorf("error inserting replacement top clip: %w", err)
+			}
+		}
+
+		err := tx.Create(&deadClip).Error
+		if err != nil {
+			return err
+		}
+
+		return rerankTopClips(tx, deadTopClip.EmoteID, deadTopClip.Span)
+	})
+}
+
+// a replacement usually counts less than the clip it took over from, and a rank left
+// without one leaves a gap, so the emote's ranks are numbered again by count
+func rerankTopClips(db *gorm.DB, emoteID int, span TimeRange) error {
+	return db.Exec(`
+	UPDATE top_clips
+	SET rank = ranked.rank
+	FROM (
+		SELECT id, ROW_NUMBER() OVER (ORDER BY count DESC, rank, id) AS rank
+		FROM top_clips
+		WHERE emote_id = ? AND span = ? AND deleted_at IS NULL
+	) ranked
+	WHERE top_clips.id = ranked.id
+	`, emoteID, span).Error
+}
+
+// rankedClipIDs stops us from promoting a clip that already holds a rank for this emote and span
+func rankedClipIDs(emoteID int, span TimeRange) sq.SelectBuilder {
+	return statementBuilder().
+		Select("clip_id").
+		From("top_clips").
+		Where(sq.Eq{"emote_id": emoteID, "span": span, "deleted_at": nil})
+}
+
+// the peak that produced the dead clip usually has several other clips within the bit
+// length, any of which capture the same moment.
+func nextBestClipInPeak(deadTopClip TopClip, db *gorm.DB) (*Clip, error) {
+	peakTime := statementBuilder().
+		Select("created_at").
+		From("emote_counts").
+		Where(sq.Eq{"clip_id": deadTopClip.ClipID, "emote_id": deadTopClip.EmoteID}).
+		Limit(1)
+
+	peakTimeQuery, peakTimeArgs, err := peakTime.ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var createdAt time.Time
+	err = db.Raw(peakTimeQuery, peakTimeArgs...).Scan(&createdAt).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if createdAt.IsZero() {
+		return nil, nil
+	}
+
+	// matches likelyBitLength
+	window := time.Minute
+
+	query, args, err := statementBuilder().
+		Select("ec.clip_id", "ec.created_at as time").
+		From("emote_counts ec").
+		Join("fetched_clips fc ON fc.clip_id = ec.clip_id").
+		Where(sq.Eq{"ec.emote_id": deadTopClip.EmoteID}).
+		Where(sq.GtOrEq{"ec.created_at": createdAt.Add(-window)}).
+		Where(sq.LtOrEq{"ec.created_at": createdAt.Add(window)}).
+		Where(sq.NotEq{"ec.clip_id": noClipSentinel}).
+		Where(sq.Eq{"fc.dead": false}).
+		Where(rankedClipIDs(deadTopClip.EmoteID, deadTopClip.Span).Prefix("ec.clip_id NOT IN (").Suffix(")")).
+		OrderBy("ec.count DESC").
+		Limit(1).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var clips []Clip
+	err = db.Raw(query, args...).Scan(&clips).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(clips) == 0 {
+		return nil, nil
+	}
+
+	clip := clips[0]
+	// same peak, same rolling sum
+	clip.Count = deadTopClip.Count
+
+	return &clip, nil
+}
+
+// falls back to the highest peak for the span that isn't ranked yet
+func nextBestPeakClip(deadTopClip TopClip, db *gorm.DB) (*Clip, error) {
+	var rankedIDs []string
+
+	err := db.Model(&TopClip{}).
+		Where("emote_id = ? AND span = ?", deadTopClip.EmoteID, deadTopClip.Span).
+		Pluck("clip_id", &rankedIDs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ranked := make(map[string]struct{}, len(rankedIDs))
+	for _, clipID := range rankedIDs {
+		ranked[clipID] = struct{}{}
+	}
+
+	peaks, err := selectClipsFromEmotePeaks(ClipCountsInput{
+		EmoteID:    deadTopClip.EmoteID,
+		TimeWindow: TimeWindow{Span: string(deadTopClip.Span)},
+		Grouping:   "25 seconds",
+		Limit:      len(rankedIDs) + allTimeLimitForSpan(deadTopClip.Span),
+		Order:      "DESC",
+	}, db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, clip := range peaks.Body {
+		if clip.ClipID == noClipSentinel {
+			continue
+		}
+
+		if _, ok := ranked[clip.ClipID]; !ok {
+			return &clip, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func fetchClipsData(clipIDs []string, tokenManager *TokenManager, db *gorm.DB, retries ...int) ([]TwitchClip, error) {
+	env := GetConfig()
+	var twitchClipResponse TwitchCipResponse
+
+	params := url.Values{}
+	for _, clipID := range clipIDs {
+		params.Add("id", clipID)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, "https://api.twitch.tv/helix/clips?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Client-ID", env.ClientId)
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tokenManager.AccessToken))
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized && len(retries) == 0 {
+		if err := tokenManager.RefreshToken(db); err != nil {
+			return nil, err
+		}
+		return fetchClipsData(clipIDs, tokenManager, db, 1)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&twitchClipResponse); err != nil {
+		return nil, fmt.Errorf("error decoding clip data: %w", err)
+	}
+
+	return twitchClipResponse.Data, nil
+}
+
+func selectDeadClipReport(db *gorm.DB) (*DeadClipReportOutput, error) {
+	query, args, err := statementBuilder().
+		Select("span", "count(*) as dead", "count(NULLIF(replacement_clip_id, '')) as replaced").
+		From("dead_clips").
+		Where(sq.Eq{"deleted_at": nil}).
+		GroupBy("span").
+		OrderBy("span").
+		ToSql()
+	if err != nil {
+		return &DeadClipReportOutput{}, err
+	}
+
+	counts := []DeadClipSpanCount{}
+
+	err = db.Raw(query, args...).Scan(&counts).Error
+	if err != nil {
+		fmt.Println(err)
+		return &DeadClipReportOutput{}, err
+	}
+
+	return &DeadClipReportOutput{Body: counts}, nil
+}
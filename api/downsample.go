@@ -0,0 +1,254 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// with no max_points, auto grouping aims for about this many buckets. nine hours of
+// minutes, the default chart, fits.
+const defaultSeriesPoints = 1000
+
+// the finest grouping that keeps the window under maxPoints buckets, from the ones
+// an endpoint can serve. all time is measured from the first day we have data for.
+func autoGrouping(window ResolvedWindow, maxPoints int, allowed []string, earliest func() (time.Time, error)) (string, error) {
+	if maxPoints <= 0 {
+		maxPoints = defaultSeriesPoints
+	}
+
+	length := window.length()
+	if length == 0 {
+		first, err := earliest()
+		if err != nil {
+			return "", err
+		}
+
+		length = time.Since(first)
+	}
+
+	for _, grouping := range allowed {
+		if int(length/groupingToDuration[grouping]) <= maxPoints {
+			return grouping, nil
+		}
+	}
+
+	return allowed[len(allowed)-1], nil
+}
+
+// thins a series to at most maxPoints points, keeping the shape of the chart. each code
+// picks its share of them, and a time kept for one code keeps every code's value
+// there, so every point is still a real sum. a run of nulls keeps its first point, so
+// gaps still break the line.
+func downsampleSeries(series []TimeSeries, maxPoints int, mode string) []TimeSeries {
+	if maxPoints <= 0 || len(series) <= maxPoints {
+		return series
+	}
+
+	codes := make(map[string]bool)
+	for _, point := range series {
+		for code := range point.Series {
+			codes[code] = true
+		}
+	}
+
+	keep := make([]bool, len(series))
+	gaps := 0
+
+	for i, point := range series {
+		if isGap(point) && (i == 0 || !isGap(series[i-1])) {
+			keep[i] = true
+			gaps++
+		}
+	}
+
+	share := max((maxPoints-gaps)/max(len(codes), 1), 1)
+
+	for code := range codes {
+		values := make([]float64, 0, len(series))
+		indices := make([]int, 0, len(series))
+
+		for i, point := range series {
+			if value := point.Series[code]; value != nil {
+				values = append(values, *value)
+				indices = append(indices, i)
+			}
+		}
+
+		var selected []int
+		if mode == "minmax" {
+			selected = minMaxIndices(values, share)
+		} else {
+			selected = lttbIndices(indices, values, share)
+		}
+
+		for _, i := range selected {
+			keep[indices[i]] = true
+		}
+	}
+
+	kept := make([]int, 0, maxPoints)
+	for i := range series {
+		if keep[i] {
+			kept = append(kept, i)
+		}
+	}
+
+	// codes peaking at different times, or a lot of gaps, can still add up to more
+	if len(kept) > maxPoints {
+		thinned := make([]int, 0, maxPoints)
+		for _, i := range evenlySpaced(len(kept), maxPoints) {
+			thinned = append(thinned, kept[i])
+		}
+		kept = thinned
+	}
+
+	downsampled := make([]TimeSeries, 0, len(kept))
+	for _, i := range kept {
+		downsampled = append(downsampled, series[i])
+	}
+
+	return downsampled
+}
+
+// a point where we weren't ingesting, null for every code
+func isGap(point TimeSeries) bool {
+	for _, value := range point.Series {
+		if value != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// count indices from 0 to n-1, spread evenly and keeping both ends
+func evenlySpaced(n int, count int) []int {
+	if count >= n {
+		count = n
+	}
+	if count == 1 {
+		return []int{0}
+	}
+
+	indices := make([]int, count)
+	for i := range indices {
+		indices[i] = i * (n - 1) / (count - 1)
+	}
+
+	return indices
+}
+
+// largest-triangle-three-buckets: the first and last points, and from each bucket in
+// between the point making the largest triangle with the last kept point and the
+// next bucket's average. x is the point's position in the full series.
+func lttbIndices(x []int, y []float64, threshold int) []int {
+	if threshold >= len(y) || threshold <= 0 {
+		all := make([]int, len(y))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	// too few for a triangle, the ends keep the line's extent and a single point its peak
+	switch threshold {
+	case 1:
+		return []int{highestIndex(y)}
+	case 2:
+		return []int{0, len(y) - 1}
+	}
+
+	selected := make([]int, 0, threshold)
+	selected = append(selected, 0)
+
+	every := float64(len(y)-2) / float64(threshold-2)
+	previous := 0
+
+	for bucket := 0; bucket < threshold-2; bucket++ {
+		start := int(float64(bucket)*every) + 1
+		end := int(float64(bucket+1)*every) + 1
+
+		nextStart := end
+		nextEnd := min(int(float64(bucket+2)*every)+1, len(y))
+
+		averageX, averageY := 0.0, 0.0
+		for i := nextStart; i < nextEnd; i++ {
+			averageX += float64(x[i])
+			averageY += y[i]
+		}
+		if count := nextEnd - nextStart; count > 0 {
+			averageX /= float64(count)
+			averageY /= float64(count)
+		} else {
+			averageX, averageY = float64(x[len(x)-1]), y[len(y)-1]
+		}
+
+		largest, largestArea := start, -1.0
+		for i := start; i < end; i++ {
+			area := math.Abs((float64(x[previous])-averageX)*(y[i]-y[previous]) -
+				(float64(x[previous])-float64(x[i]))*(averageY-y[previous]))
+
+			if area > largestArea {
+				largest, largestArea = i, area
+			}
+		}
+
+		selected = append(selected, largest)
+		previous = largest
+	}
+
+	return append(selected, len(y)-1)
+}
+
+// the lowest and highest point of each of threshold/2 buckets, so no spike is lost
+func minMaxIndices(y []float64, threshold int) []int {
+	if threshold <= 0 || len(y) <= threshold {
+		all := make([]int, len(y))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	if threshold == 1 {
+		return []int{highestIndex(y)}
+	}
+
+	buckets := threshold / 2
+
+	selected := make([]int, 0, threshold)
+	every := float64(len(y)) / float64(buckets)
+
+	for bucket := 0; bucket < buckets; bucket++ {
+		start := int(float64(bucket) * every)
+		end := min(int(float64(bucket+1)*every), len(y))
+
+		lowest, highest := start, start
+		for i := start; i < end; i++ {
+			if y[i] < y[lowest] {
+				lowest = i
+			}
+			if y[i] > y[highest] {
+				highest = i
+			}
+		}
+
+		selected = append(selected, min(lowest, highest))
+		if lowest != highest {
+			selected = append(selected, max(lowest, highest))
+		}
+	}
+
+	return selected
+}
+
+func highestIndex(y []float64) int {
+	highest := 0
+	for i := range y {
+		if y[i] > y[highest] {
+			highest = i
+		}
+	}
+
+	return highest
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
 	"gorm.io/gorm"
 )
 
@@ -73,22 +75,30 @@ func fetchNlEmotesFromBTTV() (EmoteSet, error) {
 type EmotePerformanceInput struct {
 	Date     time.Time `query:"date"`
 	Grouping string    `query:"grouping" enum:"hour,day" default:"day"`
-	Limit    int       `query:"limit" default:"20" minimum:"1"`
+	Limit    int       `query:"limit" default:"20" minimum:"1" maximum:"500"`
+	RankBy   string    `query:"rank_by" enum:"weighted_percent,zscore,poisson_pvalue" default:"weighted_percent"`
 }
 
 type LatestEmotePerformanceInput struct {
-	Limit    int    `query:"limit" default:"10" minimum:"1"`
+	Limit    int    `query:"limit" default:"10" minimum:"1" maximum:"500"`
 	Grouping string `query:"grouping" enum:"hour,day" default:"hour"`
+	RankBy   string `query:"rank_by" enum:"weighted_percent,zscore,poisson_pvalue" default:"weighted_percent"`
 }
 
 type EmoteFullRow struct {
-	EmoteURL          string
-	EmoteID           int
-	Code              string
-	Count             float64
-	Average           float64
-	Difference        float64
-	PercentDifference float64
+	EmoteURL                  string
+	EmoteID                   int
+	Code                      string
+	Count                     float64
+	Average                   float64
+	Difference                float64
+	PercentDifference         float64
+	WeightedPercentDifference float64
+	// standard deviation of the period sums the average came from
+	Stddev        float64
+	Periods       int
+	ZScore        float64
+	PoissonPValue float64
 }
 
 type EmoteReport struct {
@@ -104,12 +114,13 @@ func statementBuilder() sq.StatementBuilderType {
 	return sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 }
 
-func recentHourlyAverage() sq.SelectBuilder {
-	return recentAverage(averageHourlyViewAggregate)
+// two isn't an emote, it's a running score, so it doesn't belong in sums and rankings
+func notTwo() sq.Sqlizer {
+	return statementBuilder().Select("id").From("emotes").Where("code = 'two'").Prefix("emote_id not in (").Suffix(")")
 }
 
-func recentDailyAverage() sq.SelectBuilder {
-	return recentAverage(averageDailyViewAggregate)
+func recentHourlyAverage() sq.SelectBuilder {
+	return recentAverage(averageHourlyViewAggregate)
 }
 
 func recentAverage(averageAggregate string) sq.SelectBuilder {
@@ -120,15 +131,6 @@ func recentAverage(averageAggregate string) sq.SelectBuilder {
 
 }
 
-func averageNearestToDate(averageAggregate string, date time.Time) sq.SelectBuilder {
-	return statementBuilder().
-		Select("DISTINCT ON (emote_id) emote_id, average").
-		From(averageAggregate).
-		Where(sq.LtOrEq{"bucket": date}).
-		OrderBy("emote_id, bucket DESC")
-
-}
-
 type LatestEmoteReport struct {
 	Emotes []EmoteFullRow
 	Input  LatestEmotePerformanceInput
@@ -166,7 +168,7 @@ func selectLatestPercentGrowth(p LatestEmotePerformanceInput, db *gorm.DB) (*Lat
 			Where("created_at >= now() - interval '1 hour'").
 			GroupBy("emote_id")
 
-		avgSeriesLatestPeriod = recentHourlyAverage()
+		avgSeriesLatestPeriod = recentHourlyStats()
 	case "day":
 		currentSumQuery = statementBuilder().
 			Select("sum(count) as sum", "emote_id").
@@ -174,13 +176,13 @@ func selectLatestPercentGrowth(p LatestEmotePerformanceInput, db *gorm.DB) (*Lat
 			Where("created_at >= now() - interval '1 day'").
 			GroupBy("emote_id")
 
-		avgSeriesLatestPeriod = recentDailyAverage()
+		avgSeriesLatestPeriod = recentDailyStats()
 	default:
 		fmt.Println("Unknown grouping")
 		return &LatestEmotePerformanceOutput{}, nil
 	}
 
-	result, err := selectGrowth(currentSumQuery, avgSeriesLatestPeriod, p.Limit, db)
+	result, err := selectGrowth(currentSumQuery, avgSeriesLatestPeriod, p.RankBy, p.Limit, db)
 
 	if err != nil {
 		return &LatestEmotePerformanceOutput{}, err
@@ -198,14 +200,14 @@ func selectPercentGrowthDay(p EmotePerformanceInput, db *gorm.DB) (*TopPerformin
 		From(dailyViewAggregate)
 
 	if !p.Date.IsZero() {
-		avgSeries = averageNearestToDate(averageDailyViewAggregate, p.Date)
+		avgSeries = statsNearestToDate(statsDailyViewAggregate, channelDay(p.Date))
 		currentSumQuery = filterBucketByDay(currentSumQuery, p.Date)
 	} else {
-		avgSeries = recentDailyAverage()
+		avgSeries = recentDailyStats()
 		currentSumQuery = currentSumQuery.Where(fmt.Sprintf("bucket = (SELECT MAX(bucket) FROM %s)", dailyViewAggregate))
 	}
 
-	result, err := selectGrowth(currentSumQuery, avgSeries, p.Limit, db)
+	result, err := selectGrowth(currentSumQuery, avgSeries, p.RankBy, p.Limit, db)
 
 	if err != nil {
 		return &TopPerformingEmotesOutput{}, err
@@ -215,25 +217,39 @@ func selectPercentGrowthDay(p EmotePerformanceInput, db *gorm.DB) (*TopPerformin
 
 }
 
-func selectGrowth(currentSumQuery sq.SelectBuilder, averageSumQuery sq.SelectBuilder, limit int, db *gorm.DB) ([]EmoteFullRow, error) {
+func selectGrowth(currentSumQuery sq.SelectBuilder, statsQuery sq.SelectBuilder, rankBy string, limit int, db *gorm.DB) ([]EmoteFullRow, error) {
 	baseQuery := statementBuilder().
-		Select("average", "sum", "current_sum.emote_id as emote_id").
-		FromSelect(averageSumQuery, "avg_series").
+		Select("average", "stddev", "periods", "sum", "current_sum.emote_id as emote_id").
+		FromSelect(statsQuery, "avg_series").
 		JoinClause(currentSumQuery.
 			Prefix("JOIN (").
 			Suffix(") current_sum ON current_sum.emote_id = avg_series.emote_id"))
 
 	statQuery := statementBuilder().
-		Select("*", "series.emote_id as emote_id", "sum - average as difference", "COALESCE((sum - average) / Nullif(average, 0) * 100, 0) as percent_difference", "url as emote_url").
+		Select(
+			"*",
+			"series.emote_id as emote_id",
+			"sum - average as difference",
+			"COALESCE((sum - average) / Nullif(average, 0) * 100, 0) as percent_difference",
+			"COALESCE((sum - average) / Nullif(stddev, 0), 0) as z_score",
+			"url as emote_url").
 		FromSelect(baseQuery, "series").
 		Join("emotes on emotes.id = series.emote_id")
 
-	weightedSortQuery, args, err := statementBuilder().
+	sortQuery := statementBuilder().
 		Select("*", "sum as count", "percent_difference * sum as weighted_percent_difference").
-		FromSelect(statQuery, "stat").
-		OrderBy("weighted_percent_difference DESC").
-		Limit(uint64(limit)).
-		ToSql()
+		FromSelect(statQuery, "stat")
+
+	switch rankBy {
+	case rankByZScore:
+		sortQuery = sortQuery.OrderBy("z_score DESC").Limit(uint64(limit))
+	case rankByPoissonPValue:
+		// p-values are computed in go, so we rank after scanning
+	default:
+		sortQuery = sortQuery.OrderBy("weighted_percent_difference DESC").Limit(uint64(limit))
+	}
+
+	weightedSortQuery, args, err := sortQuery.ToSql()
 
 	if err != nil {
 		fmt.Println(err)
@@ -249,20 +265,20 @@ func selectGrowth(currentSumQuery sq.SelectBuilder, averageSumQuery sq.SelectBui
 		return nil, err
 	}
 
-	return averages, nil
+	return rankGrowth(averages, rankBy, limit), nil
 }
 
 type EmoteSumInput struct {
-	Span     string    `query:"span" enum:"1 minute,30 minutes,1 hour,9 hours" default:"9 hours"`
-	Limit    int       `query:"limit" default:"10" minimum:"1"`
-	From     time.Time `query:"from"`
-	To       time.Time `query:"to"`
-	Grouping string    `query:"grouping" enum:"second,minute,hour,day" default:"minute"`
+	TimeWindow
+	Limit int `query:"limit" default:"10" minimum:"1" maximum:"500"`
+	// which aggregate to sum; picked from the window's length when left out
+	Grouping string `query:"grouping" enum:"second,minute,hour,day,week,month,year"`
+	Category string `query:"category" doc:"only while this game was played, at hour grouping or finer"`
 }
 
 type LatestEmoteSumInput struct {
-	Span  string `query:"span" enum:"1 minute,30 minutes,1 hour,9 hours,custom" default:"9 hours"`
-	Limit int    `query:"limit" default:"10" minimum:"1"`
+	TimeWindow
+	Limit int `query:"limit" default:"10" minimum:"1" maximum:"500"`
 }
 
 type EmoteSum struct {
@@ -277,6 +293,7 @@ type EmoteSum struct {
 type EmoteSumReport struct {
 	Emotes []EmoteSum
 	Input  EmoteSumInput
+	Window ResolvedWindow
 }
 
 type EmoteSumOutput struct {
@@ -284,12 +301,7 @@ type EmoteSumOutput struct {
 }
 
 func topEmoteIds(db *gorm.DB, p EmoteSumInput) ([]int, error) {
-	result, err := selectSums(db, EmoteSumInput{
-		Grouping: p.Grouping,
-		From:     p.From,
-		Span:     p.Span,
-		Limit:    p.Limit,
-	})
+	result, err := selectSums(db, p)
 
 	if err != nil {
 		return nil, err
@@ -305,40 +317,64 @@ func topEmoteIds(db *gorm.DB, p EmoteSumInput) ([]int, error) {
 }
 
 func selectSums(db *gorm.DB, p EmoteSumInput) (*EmoteSumOutput, error) {
-	// todo: it's possible to have invalid inputs, say span 9 hours and grouping day
-	aggregateForGrouping, ok := groupingToView[p.Grouping]
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &EmoteSumOutput{}, err
+	}
+
+	grouping := p.Grouping
+	if grouping == "" {
+		grouping = window.sumGrouping()
 
-	if !ok {
-		panic("Invalid grouping while trying to get aggregate in GetTopDensityEmotes: " + p.Grouping)
+		if (p.Category != "" || window.StreamID != 0) && !slices.Contains(segmentGroupings, grouping) {
+			grouping = "hour"
+		}
+	}
+
+	if err := validateGrouping(grouping, window, 0); err != nil {
+		return &EmoteSumOutput{}, err
+	}
+
+	if err := validateSegmentGrouping(grouping, window, p.Category); err != nil {
+		return &EmoteSumOutput{}, err
 	}
 
 	filteredCountRows := statementBuilder().Select("sum(sum) as sum", "emote_id").
-		From(aggregateForGrouping).
-		Where(statementBuilder().Select("id").From("emotes").Where("code = 'two'").Prefix("emote_id not in (").Suffix(")")).
+		From(groupingToView[grouping]).
+		Where(notTwo()).
 		GroupBy("emote_id")
 
-	if !p.From.IsZero() {
-		filteredCountRows = filterBucketByDay(filteredCountRows, p.From)
-	} else if p.Span != "" {
-		filteredCountRows = filterBucketBySpan(filteredCountRows, p.Span)
+	filteredCountRows = window.where(filteredCountRows, "bucket", groupingToBucketWidth[grouping])
+
+	if p.Category != "" {
+		filteredCountRows = filterByCategory(filteredCountRows, "bucket", p.Category, groupingToBucketWidth[grouping])
 	}
 
-	return queryEmoteSums(db, filteredCountRows, p)
+	return queryEmoteSums(db, filteredCountRows, p, window)
 
 }
 
 func selectLatestSums(p LatestEmoteSumInput, db *gorm.DB) (*EmoteSumOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &EmoteSumOutput{}, err
+	}
+
+	if window.length() == 0 || window.length() > maxLatestWindow {
+		return &EmoteSumOutput{}, huma.Error422UnprocessableEntity(fmt.Sprintf("latest sums cover at most %s, use /api/emote_sums for longer windows", maxLatestWindow))
+	}
+
 	filteredCountRows := statementBuilder().Select("sum(count) as sum", "emote_id").
 		From("emote_counts").
-		Where(statementBuilder().Select("id").From("emotes").Where("code = 'two'").Prefix("emote_id not in (").Suffix(")")).
+		Where(notTwo()).
 		GroupBy("emote_id")
 
-	filteredCountRows = addFilterCreatedAtSpan(filteredCountRows, p.Span)
+	filteredCountRows = window.where(filteredCountRows, "created_at")
 
-	return queryEmoteSums(db, filteredCountRows, EmoteSumInput{Span: p.Span, Limit: p.Limit})
+	return queryEmoteSums(db, filteredCountRows, EmoteSumInput{TimeWindow: p.TimeWindow, Limit: p.Limit}, window)
 }
 
-func queryEmoteSums(db *gorm.DB, filteredEmoteSums sq.SelectBuilder, p EmoteSumInput) (*EmoteSumOutput, error) {
+func queryEmoteSums(db *gorm.DB, filteredEmoteSums sq.SelectBuilder, p EmoteSumInput, window ResolvedWindow) (*EmoteSumOutput, error) {
 	crossJoinTotal := statementBuilder().Select("sum(sum) as total_count").
 		FromSelect(filteredEmoteSums, "count_rows").
 		Prefix("(").Suffix(") total")
@@ -375,5 +411,49 @@ func queryEmoteSums(db *gorm.DB, filteredEmoteSums sq.SelectBuilder, p EmoteSumI
 	return &EmoteSumOutput{Body: EmoteSumReport{
 		Emotes: densities,
 		Input:  p,
+		Window: window,
 	}}, nil
 }
+
+type EmotesInput struct {
+	Limit  int    `query:"limit" minimum:"0" maximum:"500" doc:"every emote when 0 or left out"`
+	Cursor string `query:"cursor"`
+}
+
+type EmoteOutput struct {
+	NextCursor string `header:"X-Next-Cursor"`
+	Body       []Emote
+}
+
+// every emote we track, in the order they were added
+func selectEmotes(p EmotesInput, db *gorm.DB) (*EmoteOutput, error) {
+	var after uint
+	paged, err := decodeCursor(p.Cursor, &after)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.Order("id")
+
+	if p.Limit > 0 {
+		query = query.Limit(p.Limit + 1)
+	}
+
+	if paged {
+		query = query.Where("id > ?", after)
+	}
+
+	emotes := []Emote{}
+
+	err = query.Find(&emotes).Error
+	if err != nil {
+		fmt.Println("Error getting emotes:", err)
+		return nil, err
+	}
+
+	page := pageOf(emotes, p.Limit, func(emote Emote) []any {
+		return []any{emote.ID}
+	})
+
+	return &EmoteOutput{NextCursor: page.NextCursor, Body: page.Items}, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// raw rows or an aggregate for a range, streamed row by row so a year of ten second
+// counts never sits in memory. rows come in time then emote order, so a download that
+// breaks off picks up again from the last row it got.
+type ExportInput struct {
+	TimeWindow
+	Source   string `query:"source" enum:"emote_counts,second,minute,hour,day,week,month,year" default:"minute" doc:"emote_counts for the raw rows, or a grouping's aggregate"`
+	EmoteIDs []int  `query:"emote_ids" doc:"every emote when empty"`
+	Format   string `query:"format" enum:"csv,ndjson" default:"ndjson"`
+	Cursor   string `query:"cursor" doc:"the time and emote_id of the last row received, eg 2024-03-01T05:00:00Z/12. the export carries on after it, and csv skips the header"`
+	Limit    int    `query:"limit" minimum:"0" doc:"stop after this many rows, 0 for all of them"`
+	// gzipped when the client takes it
+	AcceptEncoding string `header:"Accept-Encoding"`
+}
+
+type ExportRow struct {
+	Time    time.Time `json:"time"`
+	EmoteID int       `json:"emote_id"`
+	Code    string    `json:"code"`
+	Count   float64   `json:"count"`
+}
+
+type exportCursor struct {
+	time    time.Time
+	emoteID int
+}
+
+const defaultExportDuration = "P1D"
+
+func parseExportCursor(cursor string) (*exportCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	timePart, idPart, ok := strings.Cut(cursor, "/")
+	if !ok {
+		return nil, huma.Error422UnprocessableEntity(fmt.Sprintf("invalid cursor %q, expected time/emote_id", cursor))
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, timePart)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity(fmt.Sprintf("invalid cursor time: %v", err))
+	}
+
+	emoteID, err := strconv.Atoi(idPart)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity(fmt.Sprintf("invalid cursor emote_id: %v", err))
+	}
+
+	return &exportCursor{time: at, emoteID: emoteID}, nil
+}
+
+func exportQuery(p ExportInput, window ResolvedWindow, cursor *exportCursor) sq.SelectBuilder {
+	table, timeColumn, valueColumn := "emote_counts", "emote_counts.created_at", "emote_counts.count"
+	if p.Source != "emote_counts" {
+		table = groupingToView[p.Source]
+		timeColumn, valueColumn = table+".bucket", table+".sum"
+	}
+
+	query := statementBuilder().
+		Select(timeColumn+" as time", table+".emote_id", "emotes.code", valueColumn+" as count").
+		From(table).
+		Join(fmt.Sprintf("emotes ON emotes.id = %s.emote_id", table))
+
+	query = window.where(query, timeColumn)
+
+	if len(p.EmoteIDs) > 0 {
+		query = query.Where(sq.Eq{table + ".emote_id": p.EmoteIDs})
+	}
+
+	if cursor != nil {
+		query = query.Where(sq.Expr(fmt.Sprintf("(%s, %s.emote_id) > (?, ?)", timeColumn, table), cursor.time, cursor.emoteID))
+	}
+
+	query = query.OrderBy(timeColumn, table+".emote_id")
+
+	if p.Limit > 0 {
+		query = query.Limit(uint64(p.Limit))
+	}
+
+	return query
+}
+
+// streams the export to w, calling flush every so often so rows reach the client as
+// they're read
+func writeExport(ctx context.Context, db *gorm.DB, p ExportInput, window ResolvedWindow, cursor *exportCursor, w io.Writer, flush func() error) error {
+	sql, args, err := exportQuery(p, window, cursor).ToSql()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.WithContext(ctx).Raw(sql, args...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var write func(row ExportRow) error
+	var finish func() error
+
+	if p.Format == "csv" {
+		writer := csv.NewWriter(w)
+
+		if cursor == nil {
+			err = writer.Write([]string{"time", "emote_id", "code", "count"})
+			if err != nil {
+				return err
+			}
+		}
+
+		write = func(row ExportRow) error {
+			return writer.Write([]string{
+				row.Time.Format(time.RFC3339Nano),
+				strconv.Itoa(row.EmoteID),
+				row.Code,
+				strconv.FormatFloat(row.Count, 'f', -1, 64),
+			})
+		}
+		finish = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	} else {
+		encoder := json.NewEncoder(w)
+		write = func(row ExportRow) error {
+			return encoder.Encode(row)
+		}
+		finish = func() error { return nil }
+	}
+
+	written := 0
+	for rows.Next() {
+		var row ExportRow
+
+		err = rows.Scan(&row.Time, &row.EmoteID, &row.Code, &row.Count)
+		if err != nil {
+			return err
+		}
+
+		err = write(row)
+		if err != nil {
+			return err
+		}
+
+		written++
+		if written%1000 == 0 {
+			err = finish()
+			if err == nil {
+				err = flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return finish()
+}
+
+func exportFilename(p ExportInput, window ResolvedWindow) string {
+	name := p.Source
+	if !window.From.IsZero() {
+		name += "-" + window.From.Format("2006-01-02")
+	}
+
+	return name + "." + p.Format
+}
+
+// checks everything up front, so a bad request still gets a proper error before the
+// stream starts
+func selectExport(p ExportInput, db *gorm.DB) (*huma.StreamResponse, error) {
+	window, err := p.TimeWindow.resolve(db, defaultExportDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := parseExportCursor(p.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &huma.StreamResponse{
+		Body: func(ctx huma.Context) {
+			contentType := "application/x-ndjson"
+			if p.Format == "csv" {
+				contentType = "text/csv"
+			}
+
+			ctx.SetHeader("Content-Type", contentType)
+			ctx.SetHeader("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(p, window)))
+
+			body := ctx.BodyWriter()
+			writer := body
+			var compressed *gzip.Writer
+
+			if strings.Contains(p.AcceptEncoding, "gzip") {
+				ctx.SetHeader("Content-Encoding", "gzip")
+				compressed = gzip.NewWriter(body)
+				defer compressed.Close()
+				writer = compressed
+			}
+
+			flush := func() error {
+				if compressed != nil {
+					if err := compressed.Flush(); err != nil {
+						return err
+					}
+				}
+				if flusher, ok := body.(http.Flusher); ok {
+					flusher.Flush()
+				}
+				return nil
+			}
+
+			// the status is already sent, all we can do is stop
+			err := writeExport(ctx.Context(), db, p, window, cursor, writer, flush)
+			if err != nil {
+				fmt.Println("error streaming export", err)
+			}
+		},
+	}, nil
+}
+
+// the export subcommand, eg
+//
+//	api export -source hour -duration P1M -emotes 1,2 -format csv -gzip -out hours.csv.gz
+//
+// to resume, pass the last row's time/emote_id as -cursor with -append.
+func runExport(db *gorm.DB, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+
+	source := flags.String("source", "minute", "emote_counts, or second, minute, hour, day, week, month or year")
+	from := flags.String("from", "", "RFC3339 start")
+	to := flags.String("to", "", "RFC3339 end")
+	duration := flags.String("duration", "", "ISO-8601 duration, eg P1W")
+	emotes := flags.String("emotes", "", "comma separated emote ids, every emote when empty")
+	format := flags.String("format", "ndjson", "csv or ndjson")
+	cursor := flags.String("cursor", "", "time/emote_id of the last row already exported")
+	out := flags.String("out", "", "file to write, stdout when empty")
+	appendOut := flags.Bool("append", false, "append to -out rather than replacing it")
+	compress := flags.Bool("gzip", false, "gzip the output")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	p := ExportInput{
+		TimeWindow: TimeWindow{Duration: *duration},
+		Source:     *source,
+		Format:     *format,
+		Cursor:     *cursor,
+	}
+
+	if _, ok := groupingToView[p.Source]; !ok && p.Source != "emote_counts" {
+		return fmt.Errorf("unknown source %s", p.Source)
+	}
+
+	if p.Format != "csv" && p.Format != "ndjson" {
+		return fmt.Errorf("unknown format %s", p.Format)
+	}
+
+	for bound, value := range map[*time.Time]string{&p.From: *from, &p.To: *to} {
+		if value == "" {
+			continue
+		}
+
+		*bound, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *emotes != "" {
+		for _, id := range strings.Split(*emotes, ",") {
+			emoteID, err := strconv.Atoi(strings.TrimSpace(id))
+			if err != nil {
+				return fmt.Errorf("invalid emote id %q", id)
+			}
+			p.EmoteIDs = append(p.EmoteIDs, emoteID)
+		}
+	}
+
+	window, err := p.TimeWindow.resolve(db, defaultExportDuration)
+	if err != nil {
+		return err
+	}
+
+	exportCursor, err := parseExportCursor(p.Cursor)
+	if err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+
+	if *out != "" {
+		mode := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if *appendOut {
+			mode = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+
+		file, err := os.OpenFile(*out, mode, 0o644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	flush := func() error { return nil }
+
+	if *compress {
+		// appended gzip members still read back as one stream
+		compressed := gzip.NewWriter(writer)
+		defer compressed.Close()
+		writer = compressed
+		flush = compressed.Flush
+	}
+
+	return writeExport(context.Background(), db, p, window, exportCursor, writer, flush)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// the layouts a client can ask for with Accept, besides huma's json and cbor:
+//
+//	application/vnd.nljoke.columnar+json  one time array and one value array per code
+//	application/vnd.nljoke.columnar+cbor  the same in cbor
+//	text/csv                              a row per time and a column per code
+//
+// only series have these layouts. anything else, errors included, is sent as plain
+// json or cbor under the requested type.
+const (
+	columnarJSONType = "application/vnd.nljoke.columnar+json"
+	columnarCBORType = "application/vnd.nljoke.columnar+cbor"
+	csvType          = "text/csv"
+)
+
+func apiConfig(title string, version string) huma.Config {
+	config := huma.DefaultConfig(title, version)
+	config.Components.SecuritySchemes = adminSecuritySchemes()
+
+	config.Formats[columnarJSONType] = columnarFormat(huma.DefaultJSONFormat)
+	config.Formats[columnarCBORType] = columnarFormat(huma.DefaultCBORFormat)
+	config.Formats[csvType] = huma.Format{
+		Marshal: func(w io.Writer, v any) error {
+			table, ok := v.(csvBody)
+			if !ok {
+				return huma.DefaultJSONFormat.Marshal(w, v)
+			}
+			return table.writeCSV(w)
+		},
+		Unmarshal: huma.DefaultJSONFormat.Unmarshal,
+	}
+
+	return config
+}
+
+type columnarBody interface {
+	columnar() any
+}
+
+type csvBody interface {
+	writeCSV(w io.Writer) error
+}
+
+func columnarFormat(format huma.Format) huma.Format {
+	return huma.Format{
+		Marshal: func(w io.Writer, v any) error {
+			if body, ok := v.(columnarBody); ok {
+				v = body.columnar()
+			}
+			return format.Marshal(w, v)
+		},
+		Unmarshal: format.Unmarshal,
+	}
+}
+
+// a series body. the same points as a plain slice, named so the formats above can
+// find it.
+type SeriesPoints []TimeSeries
+
+type ColumnarSeries struct {
+	Time []time.Time `json:"time"`
+	// only set in relative mode
+	StreamID          []*int                `json:"stream_id,omitempty"`
+	MinutesSinceStart []*float64            `json:"minutes_since_start,omitempty"`
+	Series            map[string][]*float64 `json:"series"`
+}
+
+func (points SeriesPoints) codes() []string {
+	seen := make(map[string]bool)
+	codes := make([]string, 0)
+
+	for _, point := range points {
+		for code := range point.Series {
+			if !seen[code] {
+				seen[code] = true
+				codes = append(codes, code)
+			}
+		}
+	}
+
+	slices.Sort(codes)
+	return codes
+}
+
+func (points SeriesPoints) relative() bool {
+	return slices.ContainsFunc(points, func(point TimeSeries) bool {
+		return point.MinutesSinceStart != nil
+	})
+}
+
+func (points SeriesPoints) columnar() any {
+	codes := points.codes()
+
+	columns := ColumnarSeries{
+		Time:   make([]time.Time, len(points)),
+		Series: make(map[string][]*float64, len(codes)),
+	}
+
+	for _, code := range codes {
+		columns.Series[code] = make([]*float64, len(points))
+	}
+
+	if points.relative() {
+		columns.StreamID = make([]*int, len(points))
+		columns.MinutesSinceStart = make([]*float64, len(points))
+	}
+
+	for i, point := range points {
+		columns.Time[i] = point.Time
+
+		if columns.MinutesSinceStart != nil {
+			columns.StreamID[i] = point.StreamID
+			columns.MinutesSinceStart[i] = point.MinutesSinceStart
+		}
+
+		for _, code := range codes {
+			columns.Series[code][i] = point.Series[code]
+		}
+	}
+
+	return columns
+}
+
+// nulls are left as empty cells
+func (points SeriesPoints) writeCSV(w io.Writer) error {
+	codes := points.codes()
+	relative := points.relative()
+
+	writer := csv.NewWriter(w)
+
+	header := []string{"time"}
+	if relative {
+		header = append(header, "stream_id", "minutes_since_start")
+	}
+
+	err := writer.Write(append(header, codes...))
+	if err != nil {
+		return err
+	}
+
+	cell := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	}
+
+	for _, point := range points {
+		row := []string{point.Time.Format(time.RFC3339)}
+		if relative {
+			row = append(row, strconv.Itoa(*point.StreamID), cell(point.MinutesSinceStart))
+		}
+
+		for _, code := range codes {
+			row = append(row, cell(point.Series[code]))
+		}
+
+		err = writer.Write(row)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+const statsDailyViewAggregate = "stats_daily_sum"
+const statsHourlyViewAggregate = "stats_hourly_sum"
+
+const (
+	rankByWeightedPercent = "weighted_percent"
+	rankByZScore          = "zscore"
+	rankByPoissonPValue   = "poisson_pvalue"
+)
+
+// weekly totals and sums of squares of each emote's hourly and daily sums, enough to
+// recover the mean and variance of a period without keeping every period around.
+func createStatsAggregates(db *gorm.DB) error {
+	statsAggregates := map[string]string{
+		statsDailyViewAggregate:  dailyViewAggregate,
+		statsHourlyViewAggregate: hourlyViewAggregate,
+	}
+
+	for aggregateName, from := range statsAggregates {
+		err := db.Exec(fmt.Sprintf(`
+			CREATE MATERIALIZED VIEW IF NOT EXISTS %s
+			WITH (timescaledb.continuous) AS
+			SELECT %s as bucket,
+				sum(sum) as total,
+				sum(sum * sum) as sum_of_squares,
+				count(*) as periods,
+				emote_id
+			FROM %s
+			GROUP BY 1, 5;`,
+			aggregateName, channelBucket("1 week", "bucket"), from)).Error
+
+		if err != nil {
+			fmt.Printf("Error creating %s view: %v\n", aggregateName, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func emoteStats(statsAggregate string) sq.SelectBuilder {
+	return statementBuilder().
+		Select(
+			"DISTINCT ON (emote_id) emote_id",
+			"total / NULLIF(periods, 0) as average",
+			"sqrt(GREATEST((sum_of_squares - total * total / NULLIF(periods, 0)) / NULLIF(periods - 1, 0), 0)) as stddev",
+			"periods").
+		From(statsAggregate).
+		OrderBy("emote_id, bucket DESC")
+}
+
+func recentHourlyStats() sq.SelectBuilder {
+	return emoteStats(statsHourlyViewAggregate)
+}
+
+func recentDailyStats() sq.SelectBuilder {
+	return emoteStats(statsDailyViewAggregate)
+}
+
+func statsNearestToDate(statsAggregate string, date time.Time) sq.SelectBuilder {
+	return emoteStats(statsAggregate).Where(sq.LtOrEq{"bucket": date})
+}
+
+// chance of seeing at least k uses of an emote in a period where we expect lambda.
+// summed in log space, starting from whichever tail is smaller, so it holds up for
+// the large counts of popular emotes.
+func poissonUpperTail(k int, lambda float64) float64 {
+	if k <= 0 {
+		return 1
+	}
+
+	if lambda <= 0 {
+		return 0
+	}
+
+	logTerm := func(i int) float64 {
+		logFactorial, _ := math.Lgamma(float64(i) + 1)
+		return -lambda + float64(i)*math.Log(lambda) - logFactorial
+	}
+
+	if float64(k) > lambda {
+		upper := 0.0
+		for i := k; ; i++ {
+			term := math.Exp(logTerm(i))
+			upper += term
+			if term <= upper*1e-12 {
+				break
+			}
+		}
+		return min(upper, 1)
+	}
+
+	lower := 0.0
+	for i := k - 1; i >= 0; i-- {
+		term := math.Exp(logTerm(i))
+		lower += term
+		if term <= lower*1e-12 {
+			break
+		}
+	}
+	return max(1-lower, 0)
+}
+
+func rankGrowth(rows []EmoteFullRow, rankBy string, limit int) []EmoteFullRow {
+	for i := range rows {
+		rows[i].PoissonPValue = poissonUpperTail(int(rows[i].Count), rows[i].Average)
+	}
+
+	if rankBy == rankByPoissonPValue {
+		slices.SortStableFunc(rows, func(i, j EmoteFullRow) int {
+			if i.PoissonPValue < j.PoissonPValue {
+				return -1
+			}
+			if i.PoissonPValue > j.PoissonPValue {
+				return 1
+			}
+			// plenty of emotes bottom out at 0, prefer the bigger jump
+			if i.Difference > j.Difference {
+				return -1
+			}
+			if i.Difference < j.Difference {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	return rows
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/sse"
+)
+
+type LiveBucketEvent struct {
+	Time   time.Time      `json:"time"`
+	Counts map[string]int `json:"counts"`
+}
+
+type LiveEmoteTotal struct {
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+type LiveTopEmotesEvent struct {
+	Time   time.Time        `json:"time"`
+	Emotes []LiveEmoteTotal `json:"emotes"`
+}
+
+// sent first on every connection, so a client that reconnects picks up where it left off
+type LiveSnapshotEvent struct {
+	Buckets   []LiveBucketEvent  `json:"buckets"`
+	TopEmotes LiveTopEmotesEvent `json:"top_emotes"`
+	Spikes    []Spike            `json:"spikes"`
+}
+
+const (
+	// ten minutes of 10 second buckets
+	liveBucketHistory = 60
+	liveSpikeHistory  = 20
+	// top emotes are ranked over the last five minutes
+	liveTopEmoteBuckets = 30
+	liveTopEmoteCount   = 10
+	// events a client can fall behind by before we drop it. it will reconnect and
+	// catch up from the snapshot.
+	liveClientBuffer = 32
+)
+
+// fans out what countEmotes sees to every connected /api/live client
+type LiveBroadcaster struct {
+	mu            sync.Mutex
+	clients       map[chan any]struct{}
+	recentBuckets []LiveBucketEvent
+	recentSpikes  []Spike
+}
+
+func newLiveBroadcaster() *LiveBroadcaster {
+	return &LiveBroadcaster{clients: make(map[chan any]struct{})}
+}
+
+func (b *LiveBroadcaster) subscribe() (chan any, LiveSnapshotEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	client := make(chan any, liveClientBuffer)
+	b.clients[client] = struct{}{}
+
+	snapshot := LiveSnapshotEvent{
+		Buckets:   slices.Clone(b.recentBuckets),
+		TopEmotes: b.topEmotes(),
+		Spikes:    slices.Clone(b.recentSpikes),
+	}
+
+	return client, snapshot
+}
+
+func (b *LiveBroadcaster) unsubscribe(client chan any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.clients[client]; ok {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+func (b *LiveBroadcaster) publishBucket(counts []EmoteCount, at time.Time) {
+	bucket := LiveBucketEvent{Time: at, Counts: make(map[string]int, len(counts))}
+
+	for _, count := range counts {
+		bucket.Counts[count.Emote.Code] = count.Count
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.recentBuckets = append(b.recentBuckets, bucket)
+	if len(b.recentBuckets) > liveBucketHistory {
+		b.recentBuckets = b.recentBuckets[len(b.recentBuckets)-liveBucketHistory:]
+	}
+
+	b.broadcast(bucket)
+	b.broadcast(b.topEmotes())
+}
+
+func (b *LiveBroadcaster) publishSpikes(spikes []Spike) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, spike := range spikes {
+		b.recentSpikes = append(b.recentSpikes, spike)
+		b.broadcast(spike)
+	}
+
+	if len(b.recentSpikes) > liveSpikeHistory {
+		b.recentSpikes = b.recentSpikes[len(b.recentSpikes)-liveSpikeHistory:]
+	}
+}
+
+// callers must hold mu
+func (b *LiveBroadcaster) broadcast(event any) {
+	for client := range b.clients {
+		select {
+		case client <- event:
+		default:
+			// too slow to keep up, don't let it hold back everyone else
+			delete(b.clients, client)
+			close(client)
+		}
+	}
+}
+
+// callers must hold mu
+func (b *LiveBroadcaster) topEmotes() LiveTopEmotesEvent {
+	totals := make(map[string]int)
+	event := LiveTopEmotesEvent{Emotes: []LiveEmoteTotal{}}
+
+	start := max(len(b.recentBuckets)-liveTopEmoteBuckets, 0)
+
+	for _, bucket := range b.recentBuckets[start:] {
+		event.Time = bucket.Time
+		for code, count := range bucket.Counts {
+			if code == "two" {
+				continue
+			}
+			totals[code] += count
+		}
+	}
+
+	for code, count := range totals {
+		if count > 0 {
+			event.Emotes = append(event.Emotes, LiveEmoteTotal{Code: code, Count: count})
+		}
+	}
+
+	slices.SortFunc(event.Emotes, func(i, j LiveEmoteTotal) int {
+		return j.Count - i.Count
+	})
+
+	if len(event.Emotes) > liveTopEmoteCount {
+		event.Emotes = event.Emotes[:liveTopEmoteCount]
+	}
+
+	return event
+}
+
+var liveEventTypes = map[string]any{
+	"snapshot":   LiveSnapshotEvent{},
+	"bucket":     LiveBucketEvent{},
+	"top_emotes": LiveTopEmotesEvent{},
+	"spike":      Spike{},
+}
+
+func streamLiveEvents(ctx context.Context, broadcaster *LiveBroadcaster, send sse.Sender) {
+	client, snapshot := broadcaster.subscribe()
+	defer broadcaster.unsubscribe(client)
+
+	if err := send.Data(snapshot); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-client:
+			if !ok {
+				return
+			}
+
+			if err := send.Data(event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -35,6 +35,11 @@ type Emote struct {
 	Url       string
 	HexColor  string
 	TopClips  []TopClip `gorm:"foreignkey:EmoteID"`
+	// emote, or for trackers, phrase or regex. see trackers.go
+	Kind          string `gorm:"default:emote"`
+	Pattern       string
+	CaseSensitive bool
+	WordBoundary  bool
 }
 
 func (e *Emote) String() string {
@@ -60,6 +65,8 @@ type FetchedClip struct {
 	ClipID    string    `gorm:"primary_key"`
 	CreatedAt time.Time `gorm:"index"`
 	Thumbnail string
+	// set once helix no longer knows about the clip, eg, it was deleted on twitch
+	Dead bool `gorm:"default:false;index"`
 }
 
 const noClipSentinel = "no_clip"
@@ -388,6 +395,38 @@ func migrateToNewModel() error {
 
 }
 
+// keep tables for our newer models in sync on startup. the emote counts hypertable
+// is still set up by migrateToNewModel, but aggregates added since are created here too.
+func migrateTables(db *gorm.DB) error {
+	err := createLongAggregates(db)
+
+	if err != nil {
+		return err
+	}
+
+	err = createStatsAggregates(db)
+
+	if err != nil {
+		return err
+	}
+
+	return db.AutoMigrate(
+		&Emote{},
+		&FetchedClip{},
+		&TopClip{},
+		&DeadClip{},
+		&StreamSession{},
+		&StreamReport{},
+		&CategorySegment{},
+		&Spike{},
+		&EmotePairCount{},
+		&MessageCount{},
+		&CompositeIndex{},
+		&AdminKey{},
+		&AuditLog{},
+	)
+}
+
 func concurrentBatchInsert[Row EmoteCount | FetchedClip | TopClip](db *gorm.DB, rows []Row, workerCount ...int) error {
 	var wg sync.WaitGroup
 	numWorkers := 0
@@ -614,24 +653,36 @@ func initTimescaledb(db *gorm.DB) error {
 		return err
 	}
 
+	return createDayAggregates(db)
+}
+
+// the aggregates bucketed by channel-local days and weeks, everything from daily_sum up
+// plus the weekly averages and stats over hours.
+func createDayAggregates(db *gorm.DB) error {
 	dailyAggregateName := groupingToView["day"]
 
-	err = createMaterializedView(db, hourlyAggregateName, "1 day", dailyAggregateName)
+	err := createMaterializedView(db, hourlyViewAggregate, "1 day", dailyAggregateName)
 
 	if err != nil {
 		fmt.Println("Error creating daily aggregate: ", err)
 		return err
 	}
 
+	err = createLongAggregates(db)
+
+	if err != nil {
+		return err
+	}
+
 	err = db.Exec(fmt.Sprintf(`
 			CREATE MATERIALIZED VIEW IF NOT EXISTS %s
 			WITH (timescaledb.continuous) AS 
-			SELECT time_bucket('1 week'::interval, bucket) as bucket, 
+			SELECT %s as bucket, 
 				avg(sum) as average, 
 				emote_id
 			FROM %s
 			GROUP BY 1, 3;`,
-		averageDailyViewAggregate, dailyViewAggregate)).Error
+		averageDailyViewAggregate, channelBucket("1 week", "bucket"), dailyViewAggregate)).Error
 
 	if err != nil {
 		fmt.Println("Error creating avg_daily_sum view:", err)
@@ -641,22 +692,69 @@ func initTimescaledb(db *gorm.DB) error {
 	err = db.Exec(fmt.Sprintf(`
 			CREATE MATERIALIZED VIEW IF NOT EXISTS %s
 			WITH (timescaledb.continuous) AS 
-			SELECT time_bucket('1 week'::interval, bucket) as bucket, 
+			SELECT %s as bucket, 
 				avg(sum) as average, 
 				emote_id
 			FROM %s
 			GROUP BY 1, 3;`,
-		averageHourlyViewAggregate, hourlyViewAggregate)).Error
+		averageHourlyViewAggregate, channelBucket("1 week", "bucket"), hourlyViewAggregate)).Error
 
 	if err != nil {
 		fmt.Println("Error creating avg_hourly_sum view:", err)
 		return err
 	}
 
+	err = createStatsAggregates(db)
+
+	if err != nil {
+		return err
+	}
+
 	return nil
 
 }
 
+// drops and rebuilds the day-bucketed aggregates, for when they were created with utc
+// days or the channel's timezone changes. everything is recomputed from hourly_sum.
+func rebucketDayAggregates(db *gorm.DB) error {
+	dayAggregates := []string{
+		dailyViewAggregate,
+		weeklyViewAggregate,
+		monthlyViewAggregate,
+		yearlyViewAggregate,
+		averageDailyViewAggregate,
+		averageHourlyViewAggregate,
+		statsDailyViewAggregate,
+		statsHourlyViewAggregate,
+	}
+
+	for _, aggregate := range dayAggregates {
+		err := db.Exec(fmt.Sprintf("DROP MATERIALIZED VIEW IF EXISTS %s CASCADE", aggregate)).Error
+
+		if err != nil {
+			fmt.Printf("Error dropping %s: %v\n", aggregate, err)
+			return err
+		}
+	}
+
+	err := createDayAggregates(db)
+
+	if err != nil {
+		return err
+	}
+
+	for _, aggregate := range dayAggregates {
+		err = db.Exec(fmt.Sprintf("CALL refresh_continuous_aggregate('%s', NULL, NULL)", aggregate)).Error
+
+		if err != nil {
+			fmt.Printf("Error refreshing %s: %v\n", aggregate, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func buildEmoteCount(count int, emote Emote, oldChatCount ChatCounts) EmoteCount {
 	return EmoteCount{
 		Count:     count,
@@ -677,6 +775,31 @@ func buildEmoteCountNoClip(count int, emote Emote, oldChatCount ChatCounts) Emot
 	}
 }
 
+// weekly, monthly and yearly sums for the long groupings. month and year buckets
+// vary in length, which continuous aggregates only allow on top of another aggregate.
+func createLongAggregates(db *gorm.DB) error {
+	longAggregates := []struct {
+		from     string
+		grouping string
+		name     string
+	}{
+		{dailyViewAggregate, "1 week", weeklyViewAggregate},
+		{dailyViewAggregate, "1 month", monthlyViewAggregate},
+		{monthlyViewAggregate, "1 year", yearlyViewAggregate},
+	}
+
+	for _, aggregate := range longAggregates {
+		err := createMaterializedView(db, aggregate.from, aggregate.grouping, aggregate.name)
+
+		if err != nil {
+			fmt.Printf("Error creating %s aggregate: %v\n", aggregate.name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 type RefreshPolicy struct {
 	StartOffset      string
 	EndOffset        string
@@ -689,11 +812,11 @@ func createMaterializedView(db *gorm.DB, from string, grouping string, aggregate
 			WITH (timescaledb.continuous) AS
 			SELECT emote_id, 
 				sum(sum) as sum,
-				time_bucket('%s', bucket) as bucket
+				%s as bucket
 			FROM %s
 			GROUP BY 1, 3
 			ORDER BY bucket;`,
-		aggregateName, grouping, from)).Error
+		aggregateName, channelBucket(grouping, "bucket"), from)).Error
 
 	if err != nil {
 		fmt.Println("Error creating materialized view: ", err)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// a page of a list endpoint. bodies stay plain arrays, and the cursor for the page after
+// goes out in the X-Next-Cursor header. it's opaque, pass it back as cursor, and it's
+// left out on the last page.
+//
+// pages are keyset, not offset: a cursor holds the sort key of the last item, so rows
+// arriving while someone pages through don't shift or repeat what they see.
+type Page[T any] struct {
+	Items      []T
+	NextCursor string
+}
+
+const nextCursorHeader = "X-Next-Cursor"
+
+func encodeCursor(keys ...any) string {
+	encoded, _ := json.Marshal(keys)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// reads a cursor back into keys, in the order they were encoded. an empty cursor is the
+// first page, reported as false.
+func decodeCursor(cursor string, keys ...any) (bool, error) {
+	if cursor == "" {
+		return false, nil
+	}
+
+	invalid := huma.Error422UnprocessableEntity(fmt.Sprintf("invalid cursor %q", cursor))
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return false, invalid
+	}
+
+	var raw []json.RawMessage
+	err = json.Unmarshal(decoded, &raw)
+	if err != nil || len(raw) != len(keys) {
+		return false, invalid
+	}
+
+	for i, key := range keys {
+		err = json.Unmarshal(raw[i], key)
+		if err != nil {
+			return false, invalid
+		}
+	}
+
+	return true, nil
+}
+
+// lists fetch one row past the limit, so there's a next page exactly when it came back.
+// the cursor is the sort key of the last item kept.
+func pageOf[T any](items []T, limit int, key func(item T) []any) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+
+	if limit <= 0 || len(items) <= limit {
+		return Page[T]{Items: items}
+	}
+
+	items = items[:limit]
+
+	return Page[T]{Items: items, NextCursor: encodeCursor(key(items[limit-1])...)}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// smoothing longer than this flattens any chart we draw into a line
+const maxRollingWindow = 366 * 24 * time.Hour
+
+// how a series' rows turn into points
+type seriesOptions struct {
+	grouping string
+	// an ISO-8601 duration each point is smoothed over, "" for none
+	rolling    string
+	smoothing  string
+	maxPoints  int
+	downsample string
+	// key points by stream and minutes since it started
+	relative bool
+}
+
+// the duration to smooth over. rollingAverage is the older form, a count of buckets
+// before each one, and reads as that many of the grouping's widths.
+func resolveRolling(rollingAverage int, rolling string, grouping string) (string, error) {
+	if rollingAverage != 0 && rolling != "" {
+		return "", huma.Error422UnprocessableEntity("use either rolling or rollingAverage, not both")
+	}
+
+	if rollingAverage < 0 {
+		return "", huma.Error422UnprocessableEntity("rollingAverage can't be negative")
+	}
+
+	if rollingAverage > 0 {
+		rolling = map[string]string{
+			"second": fmt.Sprintf("PT%dS", rollingAverage*10),
+			"minute": fmt.Sprintf("PT%dM", rollingAverage),
+			"hour":   fmt.Sprintf("PT%dH", rollingAverage),
+			"day":    fmt.Sprintf("P%dD", rollingAverage),
+			"week":   fmt.Sprintf("P%dW", rollingAverage),
+			"month":  fmt.Sprintf("P%dM", rollingAverage),
+			"year":   fmt.Sprintf("P%dY", rollingAverage),
+		}[grouping]
+	}
+
+	if rolling == "" {
+		return "", nil
+	}
+
+	duration, err := parseISODuration(rolling)
+	if err != nil {
+		return "", huma.Error422UnprocessableEntity(err.Error())
+	}
+
+	if duration.approximate() > maxRollingWindow {
+		return "", huma.Error422UnprocessableEntity("rolling windows can be at most a year")
+	}
+
+	return rolling, nil
+}
+
+// the sum column of a series, smoothed over the rolling window. sum and avg are window
+// functions over a time range, so sparse buckets don't stretch it. ewma and median
+// can't be, and are left to smoothRows.
+func rollingColumn(options seriesOptions) sq.Sqlizer {
+	if options.rolling == "" || (options.smoothing != "sum" && options.smoothing != "avg") {
+		return sq.Expr("sum")
+	}
+
+	return sq.Expr(fmt.Sprintf(
+		"%s(sum) OVER (PARTITION BY emote_id ORDER BY bucket RANGE BETWEEN ?::interval PRECEDING AND CURRENT ROW) as sum",
+		strings.ToUpper(options.smoothing)),
+		options.rolling)
+}
+
+// applies the smoothing rollingColumn couldn't, per code and in bucket order
+func smoothRows(rows []TimeSeriesRow, options seriesOptions) {
+	if options.rolling == "" || (options.smoothing != "ewma" && options.smoothing != "median") {
+		return
+	}
+
+	// validated by resolveRolling
+	duration, _ := parseISODuration(options.rolling)
+
+	byCode := make(map[string][]int)
+	for i, row := range rows {
+		byCode[row.Code] = append(byCode[row.Code], i)
+	}
+
+	for _, indices := range byCode {
+		slices.SortFunc(indices, func(i, j int) int {
+			return rows[i].Bucket.Compare(rows[j].Bucket)
+		})
+
+		raw := make([]float64, len(indices))
+		for i, index := range indices {
+			raw[i] = rows[index].Sum
+		}
+
+		if options.smoothing == "ewma" {
+			// the weight of a point decays by e every window length, however far apart
+			// the buckets are
+			tau := duration.approximate().Seconds()
+			smoothed := raw[0]
+
+			for i, index := range indices {
+				if i > 0 {
+					elapsed := rows[index].Bucket.Sub(rows[indices[i-1]].Bucket).Seconds()
+					alpha := 1 - math.Exp(-elapsed/tau)
+					smoothed += alpha * (raw[i] - smoothed)
+				}
+				rows[index].Sum = smoothed
+			}
+
+			continue
+		}
+
+		start := 0
+		for i, index := range indices {
+			earliest := duration.before(rows[index].Bucket)
+			for rows[indices[start]].Bucket.Before(earliest) {
+				start++
+			}
+
+			rows[index].Sum = median(raw[start : i+1])
+		}
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
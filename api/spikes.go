@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"gorm.io/gorm"
+)
+
+type Spike struct {
+	ID      int64  `json:"id"`
+	EmoteID int    `gorm:"index" json:"emote_id"`
+	Code    string `gorm:"->;-:migration" json:"code"`
+	ClipID  string `json:"clip_id"`
+	Count   int    `json:"count"`
+	// what we expected the rolling count to be
+	Baseline  float64   `json:"baseline"`
+	Magnitude float64   `json:"magnitude"`
+	ZScore    float64   `json:"z_score"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+const (
+	// how many 10 second buckets make up the rolling count
+	spikeWindowBuckets = 3
+	// weight of the newest rolling count in the moving average
+	spikeEwmaAlpha  = 0.05
+	spikeZThreshold = 4.0
+	// ignore spikes in emotes nobody uses, 1 -> 5 is not a moment
+	spikeMinimumCount = 10
+	// buckets to observe before trusting an unseeded baseline
+	spikeWarmupBuckets = 30
+	// one spike per bit
+	spikeCooldown = time.Minute
+)
+
+type emoteBaseline struct {
+	mean         float64
+	variance     float64
+	recent       []int
+	observations int
+	lastSpike    time.Time
+}
+
+// keeps an exponentially weighted mean and variance of each emote's rolling count,
+// flagging buckets that land far above it.
+type SpikeDetector struct {
+	baselines map[int]*emoteBaseline
+}
+
+func newSpikeDetector(db *gorm.DB) *SpikeDetector {
+	detector := &SpikeDetector{baselines: make(map[int]*emoteBaseline)}
+
+	err := detector.seed(db)
+	if err != nil {
+		fmt.Println("error seeding spike detector, starting cold", err)
+	}
+
+	return detector
+}
+
+// starts each baseline from last week's hourly average, so we can flag spikes right after a restart
+func (d *SpikeDetector) seed(db *gorm.DB) error {
+	query, args, err := recentHourlyAverage().ToSql()
+	if err != nil {
+		return err
+	}
+
+	var averages []struct {
+		EmoteID int
+		Average float64
+	}
+
+	err = db.Raw(query, args...).Scan(&averages).Error
+	if err != nil {
+		return err
+	}
+
+	bucketsPerHour := float64(time.Hour / (10 * time.Second))
+
+	for _, average := range averages {
+		mean := average.Average / bucketsPerHour * spikeWindowBuckets
+		d.baselines[average.EmoteID] = &emoteBaseline{
+			mean: mean,
+			// counts are roughly poisson
+			variance:     mean,
+			observations: spikeWarmupBuckets,
+		}
+	}
+
+	return nil
+}
+
+func (d *SpikeDetector) observe(counts []EmoteCount, now time.Time) []Spike {
+	spikes := make([]Spike, 0)
+
+	for _, count := range counts {
+		if count.Emote.Code == "two" {
+			continue
+		}
+
+		emoteID := int(count.Emote.ID)
+
+		baseline, ok := d.baselines[emoteID]
+		if !ok {
+			baseline = &emoteBaseline{}
+			d.baselines[emoteID] = baseline
+		}
+
+		baseline.recent = append(baseline.recent, count.Count)
+		if len(baseline.recent) > spikeWindowBuckets {
+			baseline.recent = baseline.recent[1:]
+		}
+
+		rolling := 0
+		for _, c := range baseline.recent {
+			rolling += c
+		}
+
+		standardDeviation := math.Sqrt(max(baseline.variance, 1))
+		zScore := (float64(rolling) - baseline.mean) / standardDeviation
+
+		if baseline.observations >= spikeWarmupBuckets &&
+			zScore >= spikeZThreshold &&
+			rolling >= spikeMinimumCount &&
+			now.Sub(baseline.lastSpike) >= spikeCooldown {
+
+			baseline.lastSpike = now
+			spikes = append(spikes, Spike{
+				EmoteID:   emoteID,
+				Code:      count.Emote.Code,
+				Count:     rolling,
+				Baseline:  baseline.mean,
+				Magnitude: float64(rolling) / max(baseline.mean, 1),
+				ZScore:    zScore,
+				CreatedAt: now,
+			})
+		}
+
+		// update after scoring, so the spike doesn't hide itself
+		difference := float64(rolling) - baseline.mean
+		increment := spikeEwmaAlpha * difference
+		baseline.mean += increment
+		baseline.variance = (1 - spikeEwmaAlpha) * (baseline.variance + difference*increment)
+		baseline.observations++
+	}
+
+	return spikes
+}
+
+type SpikesInput struct {
+	TimeWindow
+	EmoteID int    `query:"emote_id"`
+	Limit   int    `query:"limit" default:"50" minimum:"1" maximum:"500"`
+	Cursor  string `query:"cursor"`
+}
+
+type SpikesOutput struct {
+	NextCursor string `header:"X-Next-Cursor"`
+	Body       []Spike
+}
+
+func selectSpikes(p SpikesInput, db *gorm.DB) (*SpikesOutput, error) {
+	window, err := p.TimeWindow.resolve(db, "")
+	if err != nil {
+		return &SpikesOutput{}, err
+	}
+
+	var after Spike
+	paged, err := decodeCursor(p.Cursor, &after.CreatedAt, &after.ID)
+	if err != nil {
+		return &SpikesOutput{}, err
+	}
+
+	query := statementBuilder().
+		Select("spikes.*", "emotes.code").
+		From("spikes").
+		Join("emotes on emotes.id = spikes.emote_id").
+		OrderBy("spikes.created_at DESC", "spikes.id DESC").
+		Limit(uint64(p.Limit + 1))
+
+	query = window.where(query, "spikes.created_at")
+
+	if paged {
+		query = query.Where("(spikes.created_at, spikes.id) < (?, ?)", after.CreatedAt, after.ID)
+	}
+
+	if p.EmoteID != 0 {
+		query = query.Where(sq.Eq{"spikes.emote_id": p.EmoteID})
+	}
+
+	sql, args, err := query.ToSql()
+	if err != nil {
+		return &SpikesOutput{}, err
+	}
+
+	spikes := []Spike{}
+
+	err = db.Raw(sql, args...).Scan(&spikes).Error
+	if err != nil {
+		fmt.Println("error fetching spikes", err)
+		return &SpikesOutput{}, err
+	}
+
+	page := pageOf(spikes, p.Limit, func(spike Spike) []any {
+		return []any{spike.CreatedAt, spike.ID}
+	})
+
+	return &SpikesOutput{NextCursor: page.NextCursor, Body: page.Items}, nil
+}
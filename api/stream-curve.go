@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+type StreamCurveInput struct {
+	EmoteID       int `query:"emote_id" default:"2"`
+	Streams       int `query:"streams" default:"10" minimum:"1" maximum:"200"`
+	BucketMinutes int `query:"bucket_minutes" default:"5" minimum:"1" maximum:"120"`
+}
+
+type StreamCurvePoint struct {
+	Minute  int     `json:"minute"`
+	Average float64 `json:"average"`
+	P10     float64 `json:"p10"`
+	P25     float64 `json:"p25"`
+	Median  float64 `json:"median"`
+	P75     float64 `json:"p75"`
+	P90     float64 `json:"p90"`
+	// how many of the streams lasted long enough to reach this minute
+	Streams int `json:"streams"`
+}
+
+type StreamCurveOutput struct {
+	Body []StreamCurvePoint
+}
+
+// the shape of a typical stream for one emote: where, minutes after going live, it
+// usually peaks. every stream contributes a point to every bucket it lasted through,
+// zero if chat never used the emote then, so quiet streams pull the average down.
+func selectAverageStreamCurve(p StreamCurveInput, db *gorm.DB) (*StreamCurveOutput, error) {
+	query := fmt.Sprintf(`
+	WITH streams AS (
+		SELECT id, started_at, ended_at
+		FROM stream_sessions
+		WHERE deleted_at IS NULL AND ended_at IS NOT NULL
+		ORDER BY started_at DESC
+		LIMIT %d
+	),
+	offsets AS (
+		SELECT streams.id, streams.started_at, offset_bucket * %d AS minute
+		FROM streams
+		CROSS JOIN LATERAL generate_series(
+			0,
+			floor(EXTRACT(EPOCH FROM streams.ended_at - streams.started_at) / (60 * %d))::int
+		) offset_bucket
+	),
+	per_stream AS (
+		SELECT offsets.id, offsets.minute, COALESCE(SUM(series.sum), 0) AS sum
+		FROM offsets
+		LEFT JOIN %s series
+			ON series.emote_id = $1
+			AND series.bucket >= offsets.started_at + make_interval(mins => offsets.minute)
+			AND series.bucket < offsets.started_at + make_interval(mins => offsets.minute + %d)
+		GROUP BY offsets.id, offsets.minute
+	)
+	SELECT minute,
+		AVG(sum) AS average,
+		percentile_cont(0.1) WITHIN GROUP (ORDER BY sum) AS p10,
+		percentile_cont(0.25) WITHIN GROUP (ORDER BY sum) AS p25,
+		percentile_cont(0.5) WITHIN GROUP (ORDER BY sum) AS median,
+		percentile_cont(0.75) WITHIN GROUP (ORDER BY sum) AS p75,
+		percentile_cont(0.9) WITHIN GROUP (ORDER BY sum) AS p90,
+		COUNT(*) AS streams
+	FROM per_stream
+	GROUP BY minute
+	ORDER BY minute
+	`, p.Streams, p.BucketMinutes, p.BucketMinutes, minuteViewAggregate, p.BucketMinutes)
+
+	points := []StreamCurvePoint{}
+
+	err := db.Raw(query, p.EmoteID).Scan(&points).Error
+	if err != nil {
+		fmt.Println("error fetching average stream curve", err)
+		return &StreamCurveOutput{}, err
+	}
+
+	return &StreamCurveOutput{Body: points}, nil
+}
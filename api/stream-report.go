@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// built once when nl logs off, so the report page doesn't have to scan emote_counts
+type StreamReport struct {
+	gorm.Model
+	StreamID uint            `gorm:"uniqueIndex"`
+	Data     json.RawMessage `gorm:"type:jsonb"`
+}
+
+type StreamMoment struct {
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+	ClipID string    `json:"clip_id"`
+	Code   string    `json:"code"`
+}
+
+type StreamReportData struct {
+	Stream          StreamSession  `json:"stream"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Totals          []EmoteSum     `json:"totals"`
+	TopMoments      []StreamMoment `json:"top_moments"`
+	Risers          []EmoteFullRow `json:"risers"`
+	TwoScore        int            `json:"two_score"`
+	// chat messages per minute at the busiest minute of the stream, 0 for streams from
+	// before we counted messages
+	PeakRate   int       `json:"peak_rate"`
+	PeakRateAt time.Time `json:"peak_rate_at"`
+}
+
+type StreamReportOutput struct {
+	Body StreamReportData
+}
+
+const topMomentsInReport = 10
+const risersInReport = 10
+
+func selectStreamReport(p StreamInput, db *gorm.DB) (*StreamReportOutput, error) {
+	var stored StreamReport
+
+	err := db.Where("stream_id = ?", p.ID).Limit(1).Find(&stored).Error
+	if err != nil {
+		return &StreamReportOutput{}, err
+	}
+
+	if stored.ID == 0 {
+		// streams from before we generated reports, or one that is still live
+		report, err := buildStreamReport(uint(p.ID), db)
+		if err != nil {
+			return &StreamReportOutput{}, err
+		}
+		return &StreamReportOutput{Body: *report}, nil
+	}
+
+	var report StreamReportData
+
+	err = json.Unmarshal(stored.Data, &report)
+	if err != nil {
+		return &StreamReportOutput{}, err
+	}
+
+	return &StreamReportOutput{Body: report}, nil
+}
+
+func persistStreamReport(streamID uint, db *gorm.DB) error {
+	report, err := buildStreamReport(streamID, db)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("stream_id = ?", streamID).Delete(&StreamReport{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&StreamReport{StreamID: streamID, Data: data}).Error
+	})
+}
+
+// builds every stored report again, for when what goes into a report changes
+func rebuildStreamReports(db *gorm.DB) error {
+	var streamIDs []uint
+
+	err := db.Model(&StreamReport{}).Pluck("stream_id", &streamIDs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, streamID := range streamIDs {
+		err := persistStreamReport(streamID, db)
+		if err != nil {
+			return fmt.Errorf("error rebuilding the report for stream %d: %w", streamID, err)
+		}
+	}
+
+	fmt.Println("rebuilt stream reports: ", len(streamIDs))
+
+	return nil
+}
+
+func buildStreamReport(streamID uint, db *gorm.DB) (*StreamReportData, error) {
+	var stream StreamSession
+
+	err := db.First(&stream, streamID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, huma.Error404NotFound(fmt.Sprintf("no stream with id %d", streamID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := StreamReportData{Stream: stream}
+
+	end := time.Now()
+	if stream.EndedAt != nil {
+		end = *stream.EndedAt
+	}
+	report.DurationSeconds = end.Sub(stream.StartedAt).Seconds()
+
+	window := ResolvedWindow{From: stream.StartedAt, To: end, StreamID: int(streamID)}
+
+	streamSums := statementBuilder().
+		Select("sum(count) as sum", "emote_id").
+		From("emote_counts").
+		Where(notTwo()).
+		GroupBy("emote_id")
+	streamSums = window.where(streamSums, "created_at")
+
+	totals, err := queryEmoteSums(db, streamSums, EmoteSumInput{TimeWindow: TimeWindow{StreamID: int(streamID)}, Limit: 1000}, window)
+	if err != nil {
+		return nil, fmt.Errorf("error summing stream emotes: %w", err)
+	}
+	report.Totals = totals.Body.Emotes
+
+	risers, err := selectGrowth(
+		streamSums,
+		statsNearestToDate(statsDailyViewAggregate, stream.StartedAt),
+		rankByWeightedPercent,
+		risersInReport,
+		db,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error finding stream risers: %w", err)
+	}
+	report.Risers = risers
+
+	report.TwoScore, err = streamTwoScore(window, db)
+	if err != nil {
+		return nil, fmt.Errorf("error summing two: %w", err)
+	}
+
+	report.TopMoments, err = topMoments(func(query sq.SelectBuilder) sq.SelectBuilder {
+		return window.where(query, "created_at")
+	}, db)
+	if err != nil {
+		return nil, fmt.Errorf("error finding top moments: %w", err)
+	}
+
+	report.PeakRate, report.PeakRateAt, err = streamPeakRate(window, db)
+	if err != nil {
+		return nil, fmt.Errorf("error finding peak rate: %w", err)
+	}
+
+	return &report, nil
+}
+
+func streamTwoScore(window ResolvedWindow, db *gorm.DB) (int, error) {
+	query := statementBuilder().
+		Select("COALESCE(sum(count), 0)").
+		From("emote_counts").
+		Join("emotes on emotes.id = emote_counts.emote_id").
+		Where(sq.Eq{"emotes.code": "two"})
+
+	sql, args, err := window.where(query, "emote_counts.created_at").ToSql()
+	if err != nil {
+		return 0, err
+	}
+
+	var score int
+	err = db.Raw(sql, args...).Scan(&score).Error
+	return score, err
+}
+
+// the busiest 10 second windows of a time range, across every emote. windows within
+// likelyBitLength of a busier one are the same bit, so they're skipped.
+func topMoments(restrict func(sq.SelectBuilder) sq.SelectBuilder, db *gorm.DB) ([]StreamMoment, error) {
+	perInterval := statementBuilder().
+		Select("created_at", "sum(count) as count", "max(clip_id) as clip_id").
+		From("emote_counts").
+		Where(notTwo()).
+		GroupBy("created_at")
+	perInterval = restrict(perInterval)
+
+	topCode := statementBuilder().
+		Select("code").
+		From("emote_counts ec").
+		Join("emotes on emotes.id = ec.emote_id").
+		Where("ec.created_at = intervals.created_at").
+		Where(sq.NotEq{"emotes.code": "two"}).
+		OrderBy("ec.count DESC").
+		Limit(1).
+		Prefix("(").
+		Suffix(") as code")
+
+	query, args, err := statementBuilder().
+		Select("created_at as time", "count", "clip_id").
+		Column(topCode).
+		FromSelect(perInterval, "intervals").
+		OrderBy("count DESC").
+		Limit(topMomentsInReport * 20).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []StreamMoment
+
+	err = db.Raw(query, args...).Scan(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	moments := make([]StreamMoment, 0, topMomentsInReport)
+
+	for _, candidate := range candidates {
+		overlaps := slices.ContainsFunc(moments, func(m StreamMoment) bool {
+			return candidate.Time.Sub(m.Time).Abs() <= time.Minute
+		})
+
+		if overlaps || candidate.ClipID == noClipSentinel {
+			continue
+		}
+
+		moments = append(moments, candidate)
+
+		if len(moments) == topMomentsInReport {
+			break
+		}
+	}
+
+	return moments, nil
+}
+
+func streamPeakRate(window ResolvedWindow, db *gorm.DB) (int, time.Time, error) {
+	perMinute := statementBuilder().
+		Select("time_bucket('1 minute', created_at) as bucket", "sum(count) as count").
+		From("message_counts").
+		GroupBy("bucket").
+		OrderBy("count DESC").
+		Limit(1)
+
+	sql, args, err := window.where(perMinute, "created_at").ToSql()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	var peak struct {
+		Bucket time.Time
+		Count  int
+	}
+
+	err = db.Raw(sql, args...).Scan(&peak).Error
+	return peak.Count, peak.Bucket, err
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// one broadcast, from the first clip we managed to make to the moment nl logged off.
+// EndedAt is nil while the stream is live.
+type StreamSession struct {
+	gorm.Model
+	StartedAt      time.Time  `gorm:"index" json:"started_at"`
+	EndedAt        *time.Time `gorm:"index" json:"ended_at"`
+	Title          string     `json:"title"`
+	Category       string     `json:"category"`
+	VodID          string     `json:"vod_id"`
+	TwitchStreamID string     `json:"twitch_stream_id"`
+}
+
+// if chat goes quiet for longer than this, we consider it a new stream.
+// also lets a stream survive a restart of the api or a short outage on twitch's side.
+const streamGapThreshold = time.Hour
+
+const nlBroadcasterID = "14371185"
+
+type TwitchStream struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	GameName  string `json:"game_name"`
+	StartedAt string `json:"started_at"`
+}
+
+type TwitchStreamResponse struct {
+	Data []TwitchStream `json:"data"`
+}
+
+type TwitchVideo struct {
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+}
+
+type TwitchVideoResponse struct {
+	Data []TwitchVideo `json:"data"`
+}
+
+type StreamsInput struct {
+	TimeWindow
+	Limit  int    `query:"limit" default:"20" minimum:"1" maximum:"500"`
+	Cursor string `query:"cursor"`
+}
+
+type StreamsOutput struct {
+	NextCursor string `header:"X-Next-Cursor"`
+	Body       []StreamSession
+}
+
+type StreamInput struct {
+	ID int `path:"id"`
+}
+
+type StreamOutput struct {
+	Body StreamSession
+}
+
+func startStreamSession(db *gorm.DB, tokenManager *TokenManager) (*StreamSession, error) {
+	var latest StreamSession
+
+	err := db.Order("started_at DESC").Limit(1).Find(&latest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	if latest.ID != 0 {
+		lastActivity, err := sessionLastActivity(db, latest)
+		if err != nil {
+			return nil, err
+		}
+
+		if now.Sub(lastActivity) < streamGapThreshold {
+			// we dropped the live status for a bit, but it's the same stream
+			err := db.Model(&latest).Update("ended_at", nil).Error
+			if err != nil {
+				return nil, err
+			}
+			latest.EndedAt = nil
+			return &latest, nil
+		}
+
+		if latest.EndedAt == nil {
+			err := db.Model(&latest).Update("ended_at", lastActivity).Error
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	session := StreamSession{StartedAt: now}
+
+	stream, err := fetchLiveStream(tokenManager)
+	if err != nil {
+		fmt.Println("error fetching stream info from helix", err)
+	} else {
+		session.Title = stream.Title
+		session.Category = stream.GameName
+		session.TwitchStreamID = stream.ID
+		session.VodID = fetchVodID(stream.ID, tokenManager)
+	}
+
+	err = db.Create(&session).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// the category poller only catches up a minute in, so the stream's first category
+	// starts with the stream
+	if stream != nil {
+		err = updateCategorySegment(db, session.ID, stream.GameName, stream.Title, session.StartedAt)
+		if err != nil {
+			fmt.Println("error starting category segment", err)
+		}
+	}
+
+	return &session, nil
+}
+
+func endStreamSession(db *gorm.DB, tokenManager *TokenManager) (*StreamSession, error) {
+	var session StreamSession
+
+	err := db.Where("ended_at IS NULL").Order("started_at DESC").Limit(1).Find(&session).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if session.ID == 0 {
+		return nil, nil
+	}
+
+	updates := map[string]interface{}{"ended_at": time.Now()}
+
+	if session.VodID == "" && session.TwitchStreamID != "" {
+		// twitch sometimes only publishes the archive after the stream has been going for a bit
+		if vodID := fetchVodID(session.TwitchStreamID, tokenManager); vodID != "" {
+			updates["vod_id"] = vodID
+		}
+	}
+
+	err = db.Model(&session).Updates(updates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// when a session last saw chat. one left open, eg by the api dying mid stream, never
+// got an end, so its last emote counts stand in for it.
+func sessionLastActivity(db *gorm.DB, session StreamSession) (time.Time, error) {
+	if session.EndedAt != nil {
+		return *session.EndedAt, nil
+	}
+
+	var last *time.Time
+
+	err := db.Raw("SELECT MAX(created_at) FROM emote_counts WHERE created_at >= ?", session.StartedAt).Scan(&last).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if last == nil {
+		return session.StartedAt, nil
+	}
+
+	return *last, nil
+}
+
+// ends sessions left open with no chat for longer than streamGapThreshold, at their
+// last emote counts. run on startup, since endStreamSession never ran for them.
+func closeStaleStreamSessions(db *gorm.DB) error {
+	var open []StreamSession
+
+	err := db.Where("ended_at IS NULL").Find(&open).Error
+	if err != nil {
+		return err
+	}
+
+	for _, session := range open {
+		lastActivity, err := sessionLastActivity(db, session)
+		if err != nil {
+			return err
+		}
+
+		if time.Since(lastActivity) < streamGapThreshold {
+			continue
+		}
+
+		err = db.Model(&session).Update("ended_at", lastActivity).Error
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("closed stale stream session", session.ID)
+	}
+
+	return nil
+}
+
+// infers sessions for emote counts recorded before we tracked streams, splitting
+// wherever chat went quiet for longer than streamGapThreshold.
+func backfillStreamSessions(db *gorm.DB) error {
+	query := fmt.Sprintf(`
+	WITH uncovered AS (
+		SELECT DISTINCT created_at
+		FROM emote_counts ec
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM stream_sessions s
+			WHERE s.deleted_at IS NULL
+			AND ec.created_at BETWEEN s.started_at AND COALESCE(s.ended_at, now())
+		)
+	),
+	marked AS (
+		SELECT created_at,
+			CASE WHEN created_at - LAG(created_at) OVER (ORDER BY created_at) <= INTERVAL '%d seconds'
+				THEN 0 ELSE 1 END AS is_start
+		FROM uncovered
+	),
+	grouped AS (
+		SELECT created_at, SUM(is_start) OVER (ORDER BY created_at) AS session
+		FROM marked
+	)
+	INSERT INTO stream_sessions (created_at, updated_at, started_at, ended_at)
+	SELECT now(), now(), MIN(created_at), MAX(created_at)
+	FROM grouped
+	GROUP BY session
+	`, int(streamGapThreshold.Seconds()))
+
+	result := db.Exec(query)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	fmt.Println("backfilled stream sessions: ", result.RowsAffected)
+
+	return nil
+}
+
+func selectStreams(p StreamsInput, db *gorm.DB) (*StreamsOutput, error) {
+	window, err := p.TimeWindow.resolve(db, "")
+	if err != nil {
+		return &StreamsOutput{}, err
+	}
+
+	var after StreamSession
+	paged, err := decodeCursor(p.Cursor, &after.StartedAt, &after.ID)
+	if err != nil {
+		return &StreamsOutput{}, err
+	}
+
+	query := db.Order("started_at DESC, id DESC").Limit(p.Limit + 1)
+
+	if paged {
+		query = query.Where("(started_at, id) < (?, ?)", after.StartedAt, after.ID)
+	}
+
+	if !window.From.IsZero() {
+		query = query.Where("started_at >= ?", window.From)
+	}
+
+	if !window.To.IsZero() {
+		query = query.Where("started_at <= ?", window.To)
+	}
+
+	streams := []StreamSession{}
+
+	err = query.Find(&streams).Error
+	if err != nil {
+		fmt.Println("error fetching streams", err)
+		return &StreamsOutput{}, err
+	}
+
+	page := pageOf(streams, p.Limit, func(stream StreamSession) []any {
+		return []any{stream.StartedAt, stream.ID}
+	})
+
+	return &StreamsOutput{NextCursor: page.NextCursor, Body: page.Items}, nil
+}
+
+func selectStream(p StreamInput, db *gorm.DB) (*StreamOutput, error) {
+	var stream StreamSession
+
+	err := db.First(&stream, p.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &StreamOutput{}, huma.Error404NotFound(fmt.Sprintf("no stream with id %d", p.ID))
+	}
+	if err != nil {
+		return &StreamOutput{}, err
+	}
+
+	return &StreamOutput{Body: stream}, nil
+}
+
+var groupingToBucketWidth = map[string]string{
+	"second": "10 seconds",
+	"minute": "1 minute",
+	"hour":   "1 hour",
+	"day":    "1 day",
+	"week":   "1 week",
+	"month":  "1 month",
+	"year":   "1 year",
+}
+
+func fetchLiveStream(tokenManager *TokenManager) (*TwitchStream, error) {
+	var response TwitchStreamResponse
+
+	err := getHelix(fmt.Sprintf("https://api.twitch.tv/helix/streams?user_id=%s", nlBroadcasterID), tokenManager, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response.Data) == 0 {
+		return nil, fmt.Errorf("stream is not live")
+	}
+
+	return &response.Data[0], nil
+}
+
+func fetchVodID(twitchStreamID string, tokenManager *TokenManager) string {
+	var response TwitchVideoResponse
+
+	err := getHelix(fmt.Sprintf("https://api.twitch.tv/helix/videos?user_id=%s&type=archive&first=5", nlBroadcasterID), tokenManager, &response)
+	if err != nil {
+		fmt.Println("error fetching vods from helix", err)
+		return ""
+	}
+
+	for _, video := range response.Data {
+		if video.StreamID == twitchStreamID {
+			return video.ID
+		}
+	}
+
+	return ""
+}
+
+func getHelix(url string, tokenManager *TokenManager, out interface{}) error {
+	env := GetConfig()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Client-ID", env.ClientId)
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", tokenManager.AccessToken))
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -3,52 +3,94 @@ package main
 import (
 	"fmt"
 	"slices"
-	"strconv"
 	"time"
 
 	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
 
 	"gorm.io/gorm"
 )
 
 type TimeSeries struct {
-	Time   time.Time          `json:"time"`
-	Series map[string]float64 `json:"series"`
+	Time time.Time `json:"time"`
+	// every code for every bucket in the window. 0 when we were ingesting chat and
+	// nobody used it, null when we weren't ingesting at all, eg nl was offline.
+	Series map[string]*float64 `json:"series"`
+	// only set in relative mode, where points are keyed by these two rather than time
+	StreamID          *int     `json:"stream_id,omitempty"`
+	MinutesSinceStart *float64 `json:"minutes_since_start,omitempty"`
 }
 
 type TimeSeriesOutput struct {
-	Body []TimeSeries
+	Body SeriesPoints
 }
 
 type TimeSeriesRow struct {
 	Sum    float64
 	Bucket time.Time
 	Code   string
+	// the stream the bucket falls in, in relative mode
+	StreamID        *int
+	StreamStartedAt *time.Time
+	StreamEndedAt   *time.Time
 }
 
 type SeriesInput struct {
-	Span           string    `query:"span" enum:"1 minute,30 minutes,1 hour,9 hours" default:"9 hours"`
-	Grouping       string    `query:"grouping" enum:"second,minute,hour,day,week,month,year" default:"minute"`
-	RollingAverage int       `query:"rollingAverage"`
-	From           time.Time `query:"from"`
-	To             time.Time `query:"to"`
+	TimeWindow
+	// picked from the window and max_points when empty
+	Grouping       string `query:"grouping" enum:"second,minute,hour,day,week,month,year"`
+	RollingAverage int    `query:"rollingAverage" doc:"buckets to smooth each point over, the older form of rolling"`
+	Rolling        string `query:"rolling" doc:"ISO-8601 duration to smooth each point over, eg PT5M"`
+	Smoothing      string `query:"smoothing" enum:"sum,avg,ewma,median" default:"avg"`
+	MaxPoints      int    `query:"max_points" minimum:"0" maximum:"20000" doc:"thin the series to at most this many points, 0 for all of them"`
+	Downsample     string `query:"downsample" enum:"lttb,minmax" default:"lttb"`
 }
 
 type SeriesInputForEmotes struct {
-	Span           string    `query:"span" enum:"1 minute,30 minutes,1 hour,9 hours" default:"9 hours"`
-	Grouping       string    `query:"grouping" enum:"second,minute,hour,day,week,month,year" default:"minute"`
-	RollingAverage int       `query:"rollingAverage"`
-	From           time.Time `query:"from"`
-	To             time.Time `query:"to"`
-	EmoteIDs       []int     `query:"emote_ids"`
+	TimeWindow
+	// picked from the window and max_points when empty
+	Grouping       string `query:"grouping" enum:"second,minute,hour,day,week,month,year"`
+	RollingAverage int    `query:"rollingAverage" doc:"buckets to smooth each point over, the older form of rolling"`
+	Rolling        string `query:"rolling" doc:"ISO-8601 duration to smooth each point over, eg PT5M"`
+	Smoothing      string `query:"smoothing" enum:"sum,avg,ewma,median" default:"avg"`
+	MaxPoints      int    `query:"max_points" minimum:"0" maximum:"20000" doc:"thin the series to at most this many points, 0 for all of them"`
+	Downsample     string `query:"downsample" enum:"lttb,minmax" default:"lttb"`
+	Category       string `query:"category" doc:"only while this game was played, at hour grouping or finer"`
+	Relative       bool   `query:"relative" doc:"key points by stream and minutes since it started, leaving out anything off stream"`
+	EmoteIDs       []int  `query:"emote_ids"`
+	// composite indices to evaluate alongside the emotes, keyed by their name
+	CompositeIDs []int `query:"composite_ids"`
+}
+
+func (p SeriesInputForEmotes) seriesOptions() (seriesOptions, error) {
+	rolling, err := resolveRolling(p.RollingAverage, p.Rolling, p.Grouping)
+
+	return seriesOptions{
+		grouping:   p.Grouping,
+		rolling:    rolling,
+		smoothing:  p.Smoothing,
+		maxPoints:  p.MaxPoints,
+		downsample: p.Downsample,
+		relative:   p.Relative,
+	}, err
+}
+
+func (p SeriesInput) seriesOptions() (seriesOptions, error) {
+	return SeriesInputForEmotes{
+		Grouping:       p.Grouping,
+		RollingAverage: p.RollingAverage,
+		Rolling:        p.Rolling,
+		Smoothing:      p.Smoothing,
+		MaxPoints:      p.MaxPoints,
+		Downsample:     p.Downsample,
+	}.seriesOptions()
 }
 
 func selectLatestGreatestTimeSeries(p SeriesInputForEmotes, db *gorm.DB) (*TimeSeriesOutput, error) {
 	topEmoteIds, err := topEmoteIds(db, EmoteSumInput{
-		Grouping: p.Grouping,
-		From:     p.From,
-		Span:     p.Span,
-		Limit:    5,
+		TimeWindow: p.TimeWindow,
+		Grouping:   p.Grouping,
+		Limit:      5,
 	})
 
 	if err != nil {
@@ -56,10 +98,14 @@ func selectLatestGreatestTimeSeries(p SeriesInputForEmotes, db *gorm.DB) (*TimeS
 	}
 
 	return selectLatestSeries(SeriesInputForEmotes{
-		Grouping: p.Grouping,
-		Span:     p.Span,
-		From:     p.From,
-		EmoteIDs: topEmoteIds,
+		TimeWindow:     p.TimeWindow,
+		Grouping:       p.Grouping,
+		EmoteIDs:       topEmoteIds,
+		RollingAverage: p.RollingAverage,
+		Rolling:        p.Rolling,
+		Smoothing:      p.Smoothing,
+		MaxPoints:      p.MaxPoints,
+		Downsample:     p.Downsample,
 	}, db)
 }
 
@@ -79,10 +125,14 @@ func selectLatestTrendiestTimeSeries(p SeriesInputForEmotes, db *gorm.DB) (*Time
 
 	return selectLatestSeries(
 		SeriesInputForEmotes{
-			Grouping: p.Grouping,
-			Span:     p.Span,
-			From:     p.From,
-			EmoteIDs: trendiestEmoteIDs,
+			TimeWindow:     p.TimeWindow,
+			Grouping:       p.Grouping,
+			EmoteIDs:       trendiestEmoteIDs,
+			RollingAverage: p.RollingAverage,
+			Rolling:        p.Rolling,
+			Smoothing:      p.Smoothing,
+			MaxPoints:      p.MaxPoints,
+			Downsample:     p.Downsample,
 		},
 		db,
 	)
@@ -90,11 +140,30 @@ func selectLatestTrendiestTimeSeries(p SeriesInputForEmotes, db *gorm.DB) (*Time
 }
 
 func selectLatestSeries(p SeriesInputForEmotes, db *gorm.DB) (*TimeSeriesOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	if window.length() == 0 || window.length() > maxLatestWindow {
+		return &TimeSeriesOutput{}, huma.Error422UnprocessableEntity(fmt.Sprintf("latest series cover at most %s, use /api/series for longer windows", maxLatestWindow))
+	}
+
+	p.Grouping, err = resolveGrouping(p.Grouping, window, p.MaxPoints, latestGroupings, db)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	options, err := p.seriesOptions()
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
 	query := statementBuilder().
-		Select("sum(count) as sum", fmt.Sprintf("time_bucket('1 %s', created_at) as bucket", p.Grouping), "emote_id").
+		Select("sum(count) as sum", channelBucket(groupingToBucketWidth[p.Grouping], "created_at")+" as bucket", "emote_id").
 		From("emote_counts")
 
-	query = addFilterCreatedAtSpan(query, p.Span)
+	query = window.where(query, "created_at")
 
 	query = query.
 		Where(sq.Eq{"emote_id": p.EmoteIDs}).
@@ -106,37 +175,136 @@ func selectLatestSeries(p SeriesInputForEmotes, db *gorm.DB) (*TimeSeriesOutput,
 		Join("emotes on emotes.id = series.emote_id")
 
 	rollingSeries := statementBuilder().
-		Select(
-			"code",
-			"bucket",
-			"AVG(sum) OVER (PARTITION BY emote_id ORDER BY bucket ROWS BETWEEN "+strconv.Itoa(p.RollingAverage)+" PRECEDING AND CURRENT ROW) as sum").
+		Select("code", "bucket").
+		Column(rollingColumn(options)).
 		FromSelect(seriesJoin, "series_with_emotes")
 
-	return queryGroupAndSort(rollingSeries, db)
+	if p.Relative {
+		rollingSeries = withMinutesSinceStreamStart(rollingSeries, groupingToBucketWidth[p.Grouping])
+	}
+
+	return queryGroupAndSort(rollingSeries, window, options, db)
 }
 
 func selectSeries(p SeriesInputForEmotes, db *gorm.DB) (*TimeSeriesOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	allowed := seriesGroupings
+	if p.Category != "" || window.StreamID != 0 {
+		allowed = segmentGroupings
+	}
+
+	p.Grouping, err = resolveGrouping(p.Grouping, window, p.MaxPoints, allowed, db)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	if err := validateSegmentGrouping(p.Grouping, window, p.Category); err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	options, err := p.seriesOptions()
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	composites := []CompositeIndex{}
+
+	if len(p.CompositeIDs) > 0 {
+		composites, err = loadComposites(p.CompositeIDs, db)
+		if err != nil {
+			return &TimeSeriesOutput{}, err
+		}
+	}
+
+	rollingSeries, err := seriesQuery(p, window, options, composites)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
 
-	baseSeries := baseSeriesSelect(p)
+	return queryGroupAndSort(rollingSeries, window, options, db)
+
+}
+
+func seriesQuery(p SeriesInputForEmotes, window ResolvedWindow, options seriesOptions, composites []CompositeIndex) (sq.SelectBuilder, error) {
+	baseSeries := baseSeriesSelect(p, window)
+
+	if len(composites) > 0 {
+		union, err := unionCompositeSeries(composites, p, window)
+		if err != nil {
+			return baseSeries, err
+		}
+		baseSeries = baseSeries.SuffixExpr(union)
+	}
 
 	rollingSeries := statementBuilder().
-		Select(
-			"code",
-			"bucket",
-			"AVG(sum) OVER (PARTITION BY emote_id ORDER BY bucket ROWS BETWEEN "+strconv.Itoa(p.RollingAverage)+" PRECEDING AND CURRENT ROW) as sum").
+		Select("code", "bucket").
+		Column(rollingColumn(options)).
 		FromSelect(baseSeries, "series")
 
-	return queryGroupAndSort(rollingSeries, db)
+	if p.Relative {
+		rollingSeries = withMinutesSinceStreamStart(rollingSeries, groupingToBucketWidth[p.Grouping])
+	}
 
+	return rollingSeries, nil
+}
+
+// tags each bucket with the stream session it falls in, so queryGroupAndSort can key
+// it by how far into that stream it happened. buckets outside of any stream session
+// are left without one.
+func withMinutesSinceStreamStart(series sq.SelectBuilder, bucketWidth string) sq.SelectBuilder {
+	return statementBuilder().
+		Select(
+			"code",
+			"bucket",
+			"sum",
+			"stream.id as stream_id",
+			"stream.started_at as stream_started_at",
+			"stream.ended_at as stream_ended_at").
+		FromSelect(series, "relative_series").
+		JoinClause(fmt.Sprintf(`LEFT JOIN LATERAL (
+			SELECT id, started_at, ended_at
+			FROM stream_sessions
+			WHERE deleted_at IS NULL
+			AND relative_series.bucket >= %s
+			AND relative_series.bucket <= COALESCE(ended_at, now())
+			ORDER BY started_at DESC
+			LIMIT 1
+		) stream ON true`, channelBucket(bucketWidth, "started_at")))
 }
 
 func selectSeriesForGreatest(p SeriesInput, db *gorm.DB) (*TimeSeriesOutput, error) {
+	window, err := p.TimeWindow.resolve(db, defaultSeriesDuration)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	allowed := seriesGroupings
+	if window.StreamID != 0 {
+		allowed = segmentGroupings
+	}
+
+	p.Grouping, err = resolveGrouping(p.Grouping, window, p.MaxPoints, allowed, db)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	if err := validateSegmentGrouping(p.Grouping, window, ""); err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	options, err := p.seriesOptions()
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
 
 	topEmoteIds, err := topEmoteIds(db, EmoteSumInput{
-		Grouping: p.Grouping,
-		From:     p.From,
-		Span:     p.Span,
-		Limit:    5,
+		TimeWindow: p.TimeWindow,
+		Grouping:   p.Grouping,
+		Limit:      5,
 	})
 
 	if err != nil {
@@ -145,89 +313,31 @@ func selectSeriesForGreatest(p SeriesInput, db *gorm.DB) (*TimeSeriesOutput, err
 
 	baseSeries := baseSeriesSelect(SeriesInputForEmotes{
 		Grouping: p.Grouping,
-		Span:     p.Span,
-		From:     p.From,
 		EmoteIDs: topEmoteIds,
-	})
+	}, window)
 
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
-	rollingSeries := psql.Select(
-		"code",
-		"bucket",
-		"AVG(sum) OVER (PARTITION BY emote_id ORDER BY bucket ROWS BETWEEN "+strconv.Itoa(p.RollingAverage)+" PRECEDING AND CURRENT ROW) as sum").
+	rollingSeries := psql.Select("code", "bucket").
+		Column(rollingColumn(options)).
 		FromSelect(baseSeries, "series")
 
-	return queryGroupAndSort(rollingSeries, db)
+	return queryGroupAndSort(rollingSeries, window, options, db)
 
 }
 
-// for live view queries
-func addFilterCreatedAtSpan(query sq.SelectBuilder, span string) sq.SelectBuilder {
-	switch span {
-	case "30 minutes":
-		query = query.Where("created_at >= now() - interval '30 minutes'")
-	case "1 hour":
-		query = query.Where("created_at >= now() - interval '1 hour'")
-	case "9 hours":
-		query = query.Where("created_at >= now() - interval '9 hours'")
-	default:
-		fmt.Println("unknown span", span)
-		query = query.Where("created_at >= now() - interval '1 day'")
-	}
-
-	return query
-}
+const (
+	defaultSeriesDuration = "PT9H"
+	// latest series read emote_counts directly, which gets slow past a day
+	maxLatestWindow = 24 * time.Hour
+)
 
 func filterBucketByDay(query sq.SelectBuilder, day time.Time) sq.SelectBuilder {
-	return query.
-		Where(sq.GtOrEq{"bucket": day}).
-		Where(sq.Lt{"bucket": day.Add(time.Hour * 24)})
-}
+	start := channelDay(day)
 
-// for historical view queries; from our aggregates
-func filterBucketBySpan(query sq.SelectBuilder, span string) sq.SelectBuilder {
-	switch span {
-	case "1 minute":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '1 minute'::interval").
-			From(minuteViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "30 minutes":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '30 minutes'::interval").
-			From(minuteViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "1 hour":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '1 hour'::interval").
-			From(hourlyViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "9 hours":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '9 hours'::interval").
-			From(hourlyViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "1 week":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '1 week'::interval").
-			From(dailyViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "1 month":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '1 month'::interval").
-			From(dailyViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "1 year":
-		return query.Where(statementBuilder().Select("MAX(bucket) - '1 year'::interval").
-			From(dailyViewAggregate).
-			Prefix("bucket >= (").
-			Suffix(")"))
-	case "all":
-		return query
-	default:
-		panic("unknown span while trying to filter; huma should have caught this: " + span)
-	}
+	return query.
+		Where(sq.GtOrEq{"bucket": start}).
+		Where(sq.Lt{"bucket": start.AddDate(0, 0, 1)})
 }
 
 var groupingToView = map[string]string{
@@ -235,23 +345,108 @@ var groupingToView = map[string]string{
 	"minute": minuteViewAggregate,
 	"hour":   hourlyViewAggregate,
 	"day":    dailyViewAggregate,
+	"week":   weeklyViewAggregate,
+	"month":  monthlyViewAggregate,
+	"year":   yearlyViewAggregate,
+}
+
+// roughly how long a bucket of each grouping is, for checking it against a span
+var groupingToDuration = map[string]time.Duration{
+	"second": 10 * time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// more buckets than this per emote and a chart is unreadable anyway
+const maxSeriesBuckets = 20000
+
+var (
+	seriesGroupings = []string{"second", "minute", "hour", "day", "week", "month", "year"}
+	// latest series read emote_counts, and nothing past a day
+	latestGroupings = []string{"second", "minute", "hour"}
+	// a category or a stream lasts hours, a day bucket would reach well past it
+	segmentGroupings = []string{"second", "minute", "hour"}
+)
+
+// picks a grouping when none was asked for, then checks whichever we have against the
+// window. all time can't be grouped finer than a day.
+func resolveGrouping(grouping string, window ResolvedWindow, maxPoints int, allowed []string, db *gorm.DB) (string, error) {
+	if grouping == "" {
+		if day := slices.Index(allowed, "day"); window.length() == 0 && day >= 0 {
+			allowed = allowed[day:]
+		}
+
+		var err error
+		grouping, err = autoGrouping(window, maxPoints, allowed, func() (time.Time, error) {
+			return earliestDataTime(db)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return grouping, validateGrouping(grouping, window, maxSeriesBuckets)
+}
+
+// a grouping has to fit in the window it's asked over, and a series can't have more
+// than maxSeriesBuckets buckets. maxBuckets 0 skips the second check, eg for sums.
+func validateGrouping(grouping string, window ResolvedWindow, maxBuckets int) error {
+	width, ok := groupingToDuration[grouping]
+	if !ok {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("unsupported grouping %s", grouping))
+	}
+
+	length := window.length()
+
+	// all time
+	if length == 0 {
+		if maxBuckets > 0 && width < groupingToDuration["day"] {
+			return huma.Error422UnprocessableEntity(fmt.Sprintf("a %s grouping over all time is too many buckets, use day or longer", grouping))
+		}
+		return nil
+	}
+
+	if width > length {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("a %s grouping is longer than the %s window", grouping, length))
+	}
+
+	if maxBuckets > 0 && int(length/width) > maxBuckets {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("a %s grouping over %s is more than %d buckets", grouping, length, maxBuckets))
+	}
+
+	return nil
 }
 
-func baseSeriesSelect(p SeriesInputForEmotes) sq.SelectBuilder {
+// the aggregates only know buckets, so a category's segments or a stream can only be
+// picked out of buckets much shorter than them. in a day or a week they'd cover the
+// whole bucket and the filter would do nothing.
+func validateSegmentGrouping(grouping string, window ResolvedWindow, category string) error {
+	if slices.Contains(segmentGroupings, grouping) {
+		return nil
+	}
+
+	if category != "" {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("a %s grouping is too coarse to filter by category, use hour or finer", grouping))
+	}
+
+	if window.StreamID != 0 {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("a %s grouping is too coarse for a single stream, use hour or finer", grouping))
+	}
+
+	return nil
+}
+
+func baseSeriesSelect(p SeriesInputForEmotes, window ResolvedWindow) sq.SelectBuilder {
 	psql := sq.StatementBuilder.PlaceholderFormat(sq.Dollar)
 
 	series := psql.Select("sum, bucket, emote_id").
 		From(groupingToView[p.Grouping])
 
-	if !p.From.IsZero() && !p.To.IsZero() {
-		series = series.
-			Where(sq.LtOrEq{"bucket": p.To}).
-			Where(sq.GtOrEq{"bucket": p.From})
-	} else if !p.From.IsZero() {
-		series = filterBucketByDay(series, p.From)
-	} else if p.Span != "" {
-		series = filterBucketBySpan(series, p.Span)
-	}
+	series = filterSeries(series, p, window)
 
 	series = series.Where(sq.Eq{"emote_id": p.EmoteIDs})
 
@@ -264,7 +459,18 @@ func baseSeriesSelect(p SeriesInputForEmotes) sq.SelectBuilder {
 
 }
 
-func queryGroupAndSort(builder sq.SelectBuilder, db *gorm.DB) (*TimeSeriesOutput, error) {
+// limits an aggregate query to the window and category asked for
+func filterSeries(series sq.SelectBuilder, p SeriesInputForEmotes, window ResolvedWindow) sq.SelectBuilder {
+	series = window.where(series, "bucket", groupingToBucketWidth[p.Grouping])
+
+	if p.Category != "" {
+		series = filterByCategory(series, "bucket", p.Category, groupingToBucketWidth[p.Grouping])
+	}
+
+	return series
+}
+
+func queryGroupAndSort(builder sq.SelectBuilder, window ResolvedWindow, options seriesOptions, db *gorm.DB) (*TimeSeriesOutput, error) {
 	sql, args, err := builder.ToSql()
 
 	if err != nil {
@@ -281,30 +487,256 @@ func queryGroupAndSort(builder sq.SelectBuilder, db *gorm.DB) (*TimeSeriesOutput
 		return &TimeSeriesOutput{}, dbError
 	}
 
+	smoothRows(result, options)
+
+	if options.relative {
+		return &TimeSeriesOutput{relativeSeries(result, window, options)}, nil
+	}
+
 	output := make(map[time.Time]TimeSeries)
+	codes := make(map[string]bool)
 
 	for _, row := range result {
-		if _, ok := output[row.Bucket]; !ok {
-			output[row.Bucket] = TimeSeries{Time: row.Bucket, Series: make(map[string]float64)}
+		// keyed in utc, so the same instant from the db and from gapFillSeries matches
+		bucket := row.Bucket.UTC()
+		if _, ok := output[bucket]; !ok {
+			output[bucket] = TimeSeries{Time: bucket, Series: make(map[string]*float64)}
 		}
-		output[row.Bucket].Series[row.Code] = row.Sum
+		sum := row.Sum
+		output[bucket].Series[row.Code] = &sum
+		codes[row.Code] = true
 	}
 
-	seriesOutput := make([]TimeSeries, 0, len(output))
+	ingested, err := ingestedSpans(window, db)
+	if err != nil {
+		return &TimeSeriesOutput{}, err
+	}
+
+	seriesOutput := gapFillSeries(output, codes, window, options.grouping, ingested)
+	sortByTime(seriesOutput)
+
+	return &TimeSeriesOutput{downsampleSeries(seriesOutput, options.maxPoints, options.downsample)}, nil
+}
 
-	for _, series := range output {
-		seriesOutput = append(seriesOutput, series)
+func sortByTime(series []TimeSeries) {
+	slices.SortFunc(series, func(i TimeSeries, j TimeSeries) int {
+		return i.Time.Compare(j.Time)
+	})
+}
+
+// each stream's buckets on their own axis of minutes since it started, so streams can
+// be laid over each other. every stream is gap filled over the part of it inside the
+// window, and thinned to its share of max points. buckets off stream are dropped.
+func relativeSeries(rows []TimeSeriesRow, window ResolvedWindow, options seriesOptions) []TimeSeries {
+	type stream struct {
+		startedAt time.Time
+		// the part of the stream inside the window
+		window  ResolvedWindow
+		buckets map[time.Time]TimeSeries
 	}
 
-	slices.SortFunc(seriesOutput, func(i TimeSeries, j TimeSeries) int {
-		if i.Time.Before(j.Time) {
-			return -1
+	streams := make(map[int]*stream)
+	codes := make(map[string]bool)
+
+	for _, row := range rows {
+		codes[row.Code] = true
+
+		if row.StreamID == nil {
+			continue
 		}
-		if i.Time.After(j.Time) {
-			return 1
+
+		s, ok := streams[*row.StreamID]
+		if !ok {
+			s = &stream{
+				startedAt: *row.StreamStartedAt,
+				window:    ResolvedWindow{From: *row.StreamStartedAt, To: time.Now()},
+				buckets:   make(map[time.Time]TimeSeries),
+			}
+			if row.StreamEndedAt != nil {
+				s.window.To = *row.StreamEndedAt
+			}
+			if window.From.After(s.window.From) {
+				s.window.From = window.From
+			}
+			if !window.To.IsZero() && window.To.Before(s.window.To) {
+				s.window.To = window.To
+			}
+			streams[*row.StreamID] = s
 		}
-		return 0
-	})
 
-	return &TimeSeriesOutput{seriesOutput}, nil
+		bucket := row.Bucket.UTC()
+		if _, ok := s.buckets[bucket]; !ok {
+			s.buckets[bucket] = TimeSeries{Time: bucket, Series: make(map[string]*float64)}
+		}
+		sum := row.Sum
+		s.buckets[bucket].Series[row.Code] = &sum
+	}
+
+	ids := make([]int, 0, len(streams))
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	share := options.maxPoints
+	if share > 0 {
+		share = max(share/max(len(ids), 1), 1)
+	}
+
+	output := make([]TimeSeries, 0)
+
+	for _, id := range ids {
+		s := streams[id]
+
+		// we were ingesting for as long as the stream ran
+		points := gapFillSeries(s.buckets, codes, s.window, options.grouping, []ResolvedWindow{s.window})
+		sortByTime(points)
+
+		for i := range points {
+			streamID := id
+			// the first bucket can start before the stream does
+			minutes := max(points[i].Time.Sub(s.startedAt).Minutes(), 0)
+			points[i].StreamID = &streamID
+			points[i].MinutesSinceStart = &minutes
+		}
+
+		output = append(output, downsampleSeries(points, share, options.downsample)...)
+	}
+
+	return output
+}
+
+// lays the buckets we have over every bucket in the window. we ingest chat while nl
+// is live, so a bucket overlapping an ingested span, or one with rows for some codes,
+// has its missing codes at 0. any other bucket is null for every code.
+func gapFillSeries(buckets map[time.Time]TimeSeries, codes map[string]bool, window ResolvedWindow, grouping string, ingested []ResolvedWindow) []TimeSeries {
+	filled := make([]TimeSeries, 0, len(buckets))
+
+	for _, series := range buckets {
+		for code := range codes {
+			if _, ok := series.Series[code]; !ok {
+				zero := 0.0
+				series.Series[code] = &zero
+			}
+		}
+		filled = append(filled, series)
+	}
+
+	if len(buckets) == 0 {
+		return filled
+	}
+
+	// an open end reaches to the first or last data we have
+	first, last := time.Time{}, time.Time{}
+	for bucket := range buckets {
+		if first.IsZero() || bucket.Before(first) {
+			first = bucket
+		}
+		if bucket.After(last) {
+			last = bucket
+		}
+	}
+
+	start, end := first, last
+	if !window.From.IsZero() {
+		start = bucketStart(grouping, window.From)
+	}
+	if !window.To.IsZero() {
+		end = window.To
+		if now := time.Now(); end.After(now) {
+			end = now
+		}
+	}
+
+	for bucket := start; !bucket.After(end); bucket = nextBucket(grouping, bucket) {
+		if _, ok := buckets[bucket.UTC()]; ok {
+			continue
+		}
+
+		// spans before this bucket can't cover any later one either
+		for len(ingested) > 0 && !ingested[0].To.After(bucket) {
+			ingested = ingested[1:]
+		}
+		covered := len(ingested) > 0 && ingested[0].From.Before(nextBucket(grouping, bucket))
+
+		missing := TimeSeries{Time: bucket.UTC(), Series: make(map[string]*float64, len(codes))}
+		for code := range codes {
+			missing.Series[code] = nil
+			if covered {
+				zero := 0.0
+				missing.Series[code] = &zero
+			}
+		}
+		filled = append(filled, missing)
+	}
+
+	return filled
+}
+
+// the stream sessions overlapping the window, in order, which is when we were
+// ingesting chat. a live one runs up to now.
+func ingestedSpans(window ResolvedWindow, db *gorm.DB) ([]ResolvedWindow, error) {
+	query := db.Order("started_at")
+
+	if !window.From.IsZero() {
+		query = query.Where("COALESCE(ended_at, now()) >= ?", window.From)
+	}
+
+	if !window.To.IsZero() {
+		query = query.Where("started_at <= ?", window.To)
+	}
+
+	var sessions []StreamSession
+
+	err := query.Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	spans := make([]ResolvedWindow, 0, len(sessions))
+	for _, session := range sessions {
+		span := ResolvedWindow{From: session.StartedAt, To: time.Now()}
+		if session.EndedAt != nil {
+			span.To = *session.EndedAt
+		}
+		spans = append(spans, span)
+	}
+
+	return spans, nil
+}
+
+// the start of the grouping's bucket holding t, lined up the way time_bucket does it:
+// on the epoch under a day, on channel-local midnights, mondays and firsts above
+func bucketStart(grouping string, t time.Time) time.Time {
+	location := channelLocation()
+	local := t.In(location)
+
+	switch grouping {
+	case "day":
+		return channelDay(local)
+	case "week":
+		day := channelDay(local)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, location)
+	case "year":
+		return time.Date(local.Year(), time.January, 1, 0, 0, 0, 0, location)
+	}
+
+	return t.Truncate(groupingToDuration[grouping])
+}
+
+func nextBucket(grouping string, bucket time.Time) time.Time {
+	switch grouping {
+	case "day":
+		return bucket.AddDate(0, 0, 1)
+	case "week":
+		return bucket.AddDate(0, 0, 7)
+	case "month":
+		return bucket.AddDate(0, 1, 0)
+	case "year":
+		return bucket.AddDate(1, 0, 0)
+	}
+
+	return bucket.Add(groupingToDuration[grouping])
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// the range of time an endpoint reads, given one of these ways:
+//
+//	date, a calendar day like 2024-03-01, read as the channel's day. with a duration
+//	it counts forward from that day's midnight instead
+//	from and/or to, exact instants. from on its own runs up to now
+//	duration, an ISO-8601 duration like PT9H, P1W or P1M. it counts forward from
+//	from or date, back from to, or back from the latest data when none is given
+//	last_streams, everything since the nth most recent stream started
+//	stream_id, a single stream
+//
+// span is the older named form, eg "9 hours", and reads as the matching duration.
+// an empty window falls back to the endpoint's own default duration.
+type TimeWindow struct {
+	Date        time.Time `query:"date" timeFormat:"2006-01-02" doc:"a calendar day in the channel's timezone"`
+	From        time.Time `query:"from"`
+	To          time.Time `query:"to"`
+	Duration    string    `query:"duration" doc:"ISO-8601 duration, eg PT9H, P1W or P1Y"`
+	LastStreams int       `query:"last_streams" minimum:"0" maximum:"100"`
+	StreamID    int       `query:"stream_id"`
+	Span        string    `query:"span" enum:"1 minute,30 minutes,1 hour,9 hours,1 day,1 week,1 month,1 year,all"`
+}
+
+// a TimeWindow pinned to actual times. a zero From reaches back to the first data,
+// a zero To up to now.
+type ResolvedWindow struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	StreamID int       `json:"stream_id,omitempty"`
+	Timezone string    `json:"timezone,omitempty"`
+}
+
+// the named spans we've always accepted, as durations. all has none.
+var namedSpans = map[string]string{
+	"1 minute":   "PT1M",
+	"30 minutes": "PT30M",
+	"1 hour":     "PT1H",
+	"9 hours":    "PT9H",
+	"1 day":      "P1D",
+	"1 week":     "P1W",
+	"1 month":    "P1M",
+	"1 year":     "P1Y",
+	"all":        "",
+}
+
+type isoDuration struct {
+	years  int
+	months int
+	days   int
+	clock  time.Duration
+}
+
+var isoDurationPattern = regexp.MustCompile(`^P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseISODuration(duration string) (isoDuration, error) {
+	parts := isoDurationPattern.FindStringSubmatch(duration)
+	if parts == nil || duration == "P" || duration[len(duration)-1] == 'T' {
+		return isoDuration{}, fmt.Errorf("invalid duration %q, expected ISO-8601 like PT9H or P1W", duration)
+	}
+
+	values := make([]int, len(parts))
+	for i, part := range parts[1:] {
+		if part == "" {
+			continue
+		}
+
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return isoDuration{}, fmt.Errorf("invalid duration %q: %w", duration, err)
+		}
+		values[i+1] = value
+	}
+
+	return isoDuration{
+		years:  values[1],
+		months: values[2],
+		days:   values[3]*7 + values[4],
+		clock:  time.Duration(values[5])*time.Hour + time.Duration(values[6])*time.Minute + time.Duration(values[7])*time.Second,
+	}, nil
+}
+
+func (d isoDuration) after(t time.Time) time.Time {
+	return t.AddDate(d.years, d.months, d.days).Add(d.clock)
+}
+
+func (d isoDuration) before(t time.Time) time.Time {
+	return t.AddDate(-d.years, -d.months, -d.days).Add(-d.clock)
+}
+
+// months and years vary, so this is only for sizing, eg how many buckets a window holds
+func (d isoDuration) approximate() time.Duration {
+	return time.Duration(d.years)*365*24*time.Hour +
+		time.Duration(d.months)*30*24*time.Hour +
+		time.Duration(d.days)*24*time.Hour +
+		d.clock
+}
+
+// how long a named span is, 0 for all time
+func spanDuration(span string) (time.Duration, error) {
+	duration, ok := namedSpans[span]
+	if !ok {
+		return 0, fmt.Errorf("invalid time span, %s", span)
+	}
+
+	if duration == "" {
+		return 0, nil
+	}
+
+	parsed, err := parseISODuration(duration)
+	if err != nil {
+		return 0, err
+	}
+
+	return parsed.approximate(), nil
+}
+
+// pins the window to actual times. defaultDuration applies when the window is empty,
+// and "" means all time. the times come back in the channel's zone, which is echoed
+// alongside them.
+func (w TimeWindow) resolve(db *gorm.DB, defaultDuration string) (ResolvedWindow, error) {
+	window, err := w.resolveRange(db, defaultDuration)
+	if err != nil {
+		return ResolvedWindow{}, err
+	}
+
+	location := channelLocation()
+	if !window.From.IsZero() {
+		window.From = window.From.In(location)
+	}
+	if !window.To.IsZero() {
+		window.To = window.To.In(location)
+	}
+	window.Timezone = location.String()
+
+	return window, nil
+}
+
+func (w TimeWindow) resolveRange(db *gorm.DB, defaultDuration string) (ResolvedWindow, error) {
+	ranged := !w.Date.IsZero() || !w.From.IsZero() || !w.To.IsZero() || w.Duration != "" || w.Span != ""
+
+	if (w.StreamID != 0 && (ranged || w.LastStreams != 0)) || (w.LastStreams != 0 && ranged) {
+		return ResolvedWindow{}, huma.Error422UnprocessableEntity("use one of stream_id, last_streams or a date/from/to/duration range")
+	}
+
+	if w.Duration != "" && w.Span != "" {
+		return ResolvedWindow{}, huma.Error422UnprocessableEntity("use either duration or span, not both")
+	}
+
+	if w.StreamID != 0 {
+		var stream StreamSession
+
+		err := db.First(&stream, w.StreamID).Error
+		if err != nil {
+			return ResolvedWindow{}, huma.Error404NotFound(fmt.Sprintf("no stream with id %d", w.StreamID))
+		}
+
+		window := ResolvedWindow{From: stream.StartedAt, To: time.Now(), StreamID: w.StreamID}
+		if stream.EndedAt != nil {
+			window.To = *stream.EndedAt
+		}
+
+		return window, nil
+	}
+
+	if w.LastStreams != 0 {
+		var streams []StreamSession
+
+		err := db.Order("started_at DESC").Limit(w.LastStreams).Find(&streams).Error
+		if err != nil {
+			return ResolvedWindow{}, err
+		}
+
+		if len(streams) == 0 {
+			return ResolvedWindow{}, huma.Error404NotFound("no streams recorded yet")
+		}
+
+		return ResolvedWindow{From: streams[len(streams)-1].StartedAt, To: time.Now()}, nil
+	}
+
+	if !w.Date.IsZero() {
+		if !w.From.IsZero() || !w.To.IsZero() {
+			return ResolvedWindow{}, huma.Error422UnprocessableEntity("use either date or from/to, not both")
+		}
+
+		// a date is the channel's day, not utc's
+		w.From = channelDay(w.Date)
+
+		if w.Duration == "" && w.Span == "" {
+			return ResolvedWindow{From: w.From, To: w.From.AddDate(0, 0, 1)}, nil
+		}
+	}
+
+	duration := w.Duration
+	if w.Span != "" {
+		duration = namedSpans[w.Span]
+	} else if !ranged {
+		duration = defaultDuration
+	}
+
+	if duration == "" {
+		return ResolvedWindow{From: w.From, To: w.To}, nil
+	}
+
+	parsed, err := parseISODuration(duration)
+	if err != nil {
+		return ResolvedWindow{}, huma.Error422UnprocessableEntity(err.Error())
+	}
+
+	switch {
+	case !w.From.IsZero() && !w.To.IsZero():
+		return ResolvedWindow{}, huma.Error422UnprocessableEntity("from, to and a duration together are one too many")
+	case !w.From.IsZero():
+		return ResolvedWindow{From: w.From, To: parsed.after(w.From)}, nil
+	case !w.To.IsZero():
+		return ResolvedWindow{From: parsed.before(w.To), To: w.To}, nil
+	}
+
+	// when nl is offline, the last 9 hours means the end of the last stream
+	latest, err := latestDataTime(db)
+	if err != nil {
+		return ResolvedWindow{}, err
+	}
+
+	return ResolvedWindow{From: parsed.before(latest), To: latest}, nil
+}
+
+func latestDataTime(db *gorm.DB) (time.Time, error) {
+	var latest *time.Time
+
+	err := db.Raw("SELECT MAX(created_at) FROM emote_counts").Scan(&latest).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if latest == nil {
+		return time.Now(), nil
+	}
+
+	return *latest, nil
+}
+
+// the first day we have data for, when all time needs a length
+func earliestDataTime(db *gorm.DB) (time.Time, error) {
+	var earliest *time.Time
+
+	err := db.Raw(fmt.Sprintf("SELECT MIN(bucket) FROM %s", dailyViewAggregate)).Scan(&earliest).Error
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if earliest == nil {
+		return time.Now(), nil
+	}
+
+	return *earliest, nil
+}
+
+// back to an input, for handing a window on to another endpoint's query
+func (r ResolvedWindow) input() TimeWindow {
+	if r.StreamID != 0 {
+		return TimeWindow{StreamID: r.StreamID}
+	}
+
+	return TimeWindow{From: r.From, To: r.To}
+}
+
+// zero when the window reaches back to the first data
+func (r ResolvedWindow) length() time.Duration {
+	if r.From.IsZero() {
+		return 0
+	}
+
+	to := r.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	return to.Sub(r.From)
+}
+
+// limits a query to the window. with a bucket width, the bucket the window starts
+// in is kept, so an aggregate doesn't drop the first partial bucket.
+func (r ResolvedWindow) where(query sq.SelectBuilder, column string, bucketWidth ...string) sq.SelectBuilder {
+	if !r.From.IsZero() {
+		if len(bucketWidth) > 0 && bucketWidth[0] != "" {
+			query = query.Where(sq.Expr(fmt.Sprintf("%s >= %s", column, channelBucket(bucketWidth[0], "?::timestamptz")), r.From))
+		} else {
+			query = query.Where(sq.GtOrEq{column: r.From})
+		}
+	}
+
+	if !r.To.IsZero() {
+		query = query.Where(sq.LtOrEq{column: r.To})
+	}
+
+	return query
+}
+
+// the same limits as where, for the queries we still build by hand
+func (r ResolvedWindow) sql(column string) string {
+	predicate := ""
+
+	if !r.From.IsZero() {
+		predicate += fmt.Sprintf(" AND %s >= '%s'", column, r.From.Format(time.RFC3339Nano))
+	}
+
+	if !r.To.IsZero() {
+		predicate += fmt.Sprintf(" AND %s <= '%s'", column, r.To.Format(time.RFC3339Nano))
+	}
+
+	return predicate
+}
+
+// the coarsest aggregate that still lines up with the window's edges to within a
+// fiftieth of its length, for endpoints that only sum over the window
+func (r ResolvedWindow) sumGrouping() string {
+	length := r.length()
+	if length == 0 {
+		return "day"
+	}
+
+	grouping := "second"
+	for _, candidate := range []string{"minute", "hour", "day"} {
+		if groupingToDuration[candidate] <= length/50 {
+			grouping = candidate
+		}
+	}
+
+	return grouping
+}
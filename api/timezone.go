@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	channelLocationOnce sync.Once
+	channelLocationZone *time.Location
+)
+
+// the zone the channel streams in. days, weeks and stream dates follow its
+// midnights rather than utc's, so a late stream isn't split across two days.
+func channelLocation() *time.Location {
+	channelLocationOnce.Do(func() {
+		location, err := time.LoadLocation(GetConfig().Timezone)
+		if err == nil {
+			err = checkWholeHourOffsets(location)
+		}
+		if err != nil {
+			fmt.Printf("invalid CHANNEL_TIMEZONE %q, falling back to UTC: %v\n", GetConfig().Timezone, err)
+			location = time.UTC
+		}
+		channelLocationZone = location
+	})
+
+	return channelLocationZone
+}
+
+// channelBucket leaves buckets under a day in utc, which only lines up with the
+// channel's clock when every offset the zone uses is a whole number of hours
+func checkWholeHourOffsets(location *time.Location) error {
+	year := time.Now().Year()
+
+	for month := time.January; month <= time.December; month++ {
+		_, offset := time.Date(year, month, 1, 0, 0, 0, 0, location).Zone()
+		if offset%3600 != 0 {
+			return fmt.Errorf("%s is %ds off utc, hour buckets wouldn't line up with its clock", location, offset)
+		}
+	}
+
+	return nil
+}
+
+func channelTimezone() string {
+	return channelLocation().String()
+}
+
+// the channel-local midnight starting the calendar date t names. the date is
+// read as written, so 2024-03-01T00:00:00Z is the 1st of march wherever nl is.
+func channelDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, channelLocation())
+}
+
+// time_bucket for the given width, in the channel's zone from a day upwards.
+// shorter buckets don't care, channelLocation only takes zones a whole number of
+// hours off utc.
+func channelBucket(width string, column string) string {
+	duration, err := parseBucketWidth(width)
+	if err == nil && duration >= 24*time.Hour {
+		return fmt.Sprintf("time_bucket('%s', %s, '%s')", width, column, channelTimezone())
+	}
+
+	return fmt.Sprintf("time_bucket('%s', %s)", width, column)
+}
+
+// the postgres intervals we bucket by, eg "10 seconds", "1 day" or "1 week"
+func parseBucketWidth(width string) (time.Duration, error) {
+	var count int
+	var unit string
+
+	_, err := fmt.Sscanf(width, "%d %s", &count, &unit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bucket width %q: %w", width, err)
+	}
+
+	units := map[string]time.Duration{
+		"second": time.Second,
+		"minute": time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+		"week":   7 * 24 * time.Hour,
+		"month":  30 * 24 * time.Hour,
+		"year":   365 * 24 * time.Hour,
+	}
+
+	for name, duration := range units {
+		if unit == name || unit == name+"s" {
+			return time.Duration(count) * duration, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid bucket width %q", width)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// trackers live in the emotes table, so their counts land in emote_counts and every
+// series, sums and clip endpoint works with them by id.
+const (
+	trackerKindEmote  = "emote"
+	trackerKindPhrase = "phrase"
+	trackerKindRegex  = "regex"
+)
+
+// RE2 can't backtrack, but a huge pattern still costs us on every chat message
+const maxTrackerPatternLength = 200
+
+type TrackerInput struct {
+	Body struct {
+		Name          string `json:"name" minLength:"1" maxLength:"50"`
+		Kind          string `json:"kind" enum:"phrase,regex"`
+		Pattern       string `json:"pattern" minLength:"1"`
+		CaseSensitive bool   `json:"case_sensitive,omitempty"`
+		WordBoundary  bool   `json:"word_boundary,omitempty"`
+	}
+}
+
+type TrackerOutput struct {
+	Body Emote
+}
+
+type TrackersOutput struct {
+	Body []Emote
+}
+
+type DeleteTrackerInput struct {
+	ID int `path:"id"`
+}
+
+func compileTracker(emote Emote) (*regexp.Regexp, error) {
+	pattern := emote.Pattern
+
+	switch emote.Kind {
+	case trackerKindPhrase:
+		pattern = regexp.QuoteMeta(pattern)
+	case trackerKindRegex:
+	default:
+		return nil, fmt.Errorf("unknown tracker kind: %s", emote.Kind)
+	}
+
+	if len(pattern) > maxTrackerPatternLength {
+		return nil, fmt.Errorf("pattern is longer than %d characters", maxTrackerPatternLength)
+	}
+
+	if emote.WordBoundary {
+		pattern = fmt.Sprintf(`\b(?:%s)\b`, pattern)
+	}
+
+	if !emote.CaseSensitive {
+		pattern = "(?i)" + pattern
+	}
+
+	matcher, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	if matcher.MatchString("") {
+		return nil, fmt.Errorf("pattern matches an empty message, so it would match every message")
+	}
+
+	return matcher, nil
+}
+
+// compiled once per emote refresh instead of once per chat message
+func trackerMatchers(emotes map[int]Emote) map[int]*regexp.Regexp {
+	matchers := make(map[int]*regexp.Regexp)
+
+	for id, emote := range emotes {
+		if emote.Kind == "" || emote.Kind == trackerKindEmote {
+			continue
+		}
+
+		matcher, err := compileTracker(emote)
+		if err != nil {
+			fmt.Println("skipping tracker", emote.Code, err)
+			continue
+		}
+
+		matchers[id] = matcher
+	}
+
+	return matchers
+}
+
+func matchesMessage(emote Emote, matchers map[int]*regexp.Regexp, messageText string) bool {
+	if emote.Kind == "" || emote.Kind == trackerKindEmote {
+		return strings.Contains(messageText, emote.Code)
+	}
+
+	matcher, ok := matchers[int(emote.ID)]
+	if !ok {
+		return false
+	}
+
+	return matcher.MatchString(messageText)
+}
+
+func createTracker(input *TrackerInput, db *gorm.DB) (*TrackerOutput, error) {
+	randomHue := rand.Float64()
+
+	color := hsvToRGB(HSV{
+		Hue:        randomHue * 360,
+		Saturation: 0.6,
+		Value:      0.95,
+	})
+
+	tracker := Emote{
+		Code:          input.Body.Name,
+		Kind:          input.Body.Kind,
+		Pattern:       input.Body.Pattern,
+		CaseSensitive: input.Body.CaseSensitive,
+		WordBoundary:  input.Body.WordBoundary,
+		HexColor:      fmt.Sprintf("#%02x%02x%02x", color.Red, color.Green, color.Blue),
+	}
+
+	if _, err := compileTracker(tracker); err != nil {
+		return nil, huma.Error422UnprocessableEntity(err.Error())
+	}
+
+	// deleted rows keep their code, so look past the soft delete
+	var existing Emote
+
+	err := db.Unscoped().Where("code = ?", tracker.Code).Limit(1).Find(&existing).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.ID != 0 {
+		if !existing.DeletedAt.Valid || (existing.Kind != trackerKindPhrase && existing.Kind != trackerKindRegex) {
+			return nil, huma.Error409Conflict(fmt.Sprintf("%s is already tracked", tracker.Code))
+		}
+
+		// a deleted tracker comes back under its old id, with the counts it already had
+		err = db.Unscoped().Model(&existing).Updates(map[string]interface{}{
+			"deleted_at":     nil,
+			"kind":           tracker.Kind,
+			"pattern":        tracker.Pattern,
+			"case_sensitive": tracker.CaseSensitive,
+			"word_boundary":  tracker.WordBoundary,
+			"hex_color":      tracker.HexColor,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.First(&tracker, existing.ID).Error
+		if err != nil {
+			return nil, err
+		}
+
+		return &TrackerOutput{Body: tracker}, nil
+	}
+
+	err = db.Create(&tracker).Error
+	if err != nil {
+		fmt.Println("error creating tracker", err)
+		return nil, err
+	}
+
+	return &TrackerOutput{Body: tracker}, nil
+}
+
+func selectTrackers(db *gorm.DB) (*TrackersOutput, error) {
+	trackers := []Emote{}
+
+	err := db.Where("kind IN ?", []string{trackerKindPhrase, trackerKindRegex}).Find(&trackers).Error
+	if err != nil {
+		return &TrackersOutput{}, err
+	}
+
+	return &TrackersOutput{Body: trackers}, nil
+}
+
+func deleteTracker(input *DeleteTrackerInput, db *gorm.DB) (*struct{}, error) {
+	result := db.Where("kind IN ?", []string{trackerKindPhrase, trackerKindRegex}).Delete(&Emote{}, input.ID)
+
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return nil, huma.Error404NotFound("no tracker with that id")
+	}
+
+	return nil, nil
+}
@@ -127,11 +127,17 @@ export function useEmotes() {
   });
 }
 
+// a picked day is sent as the channel's calendar date, which covers the whole day
+// rather than a span from its midnight
+function dayParams(from?: string) {
+  return from ? { date: from.slice(0, 10), span: undefined } : {};
+}
+
 export function useEmoteSums(p?: EmoteSumParams) {
   const { from } = Route.useSearch();
   const { seriesParams } = useDashboardState();
   return useQuery({
-    queryFn: () => getEmoteSums({ ...p, from }),
+    queryFn: () => getEmoteSums({ ...p, ...dayParams(from) }),
     queryKey: ["emoteDensity", seriesParams, from, p],
     placeholderData: keepPreviousData,
   });
@@ -247,7 +253,7 @@ export function useGreatestTimeSeries() {
   const seriesParams = useSeriesParams();
 
   return useQuery({
-    queryFn: () => getSeriesGreatest({ ...seriesParams, from }),
+    queryFn: () => getSeriesGreatest({ ...seriesParams, ...dayParams(from) }),
     queryKey: ["greatestSeries", seriesParams, from],
     placeholderData: keepPreviousData,
   });
@@ -258,7 +264,7 @@ export function useTimeSeries(p?: { emote_ids?: number[] }) {
   const { from } = useDashboardState();
   const seriesParams = useSeriesParams();
 
-  const params = { ...seriesParams, from, emote_ids } as const;
+  const params = { ...seriesParams, ...dayParams(from), emote_ids } as const;
 
   return useQuery({
     queryFn: () => getSeries(params),
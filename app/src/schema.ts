@@ -408,6 +408,7 @@ export interface operations {
       query?: {
         span?: "1 minute" | "30 minutes" | "1 hour" | "9 hours";
         limit?: number;
+        date?: string;
         from?: string;
         to?: string;
         grouping?: "second" | "minute" | "hour" | "day";
@@ -696,6 +697,7 @@ export interface operations {
         span?: "1 minute" | "30 minutes" | "1 hour" | "9 hours";
         grouping?: "second" | "minute" | "hour" | "day" | "week" | "month" | "year";
         rollingAverage?: number;
+        date?: string;
         from?: string;
         to?: string;
         emote_ids?: number[];
@@ -723,6 +725,7 @@ export interface operations {
         span?: "1 minute" | "30 minutes" | "1 hour" | "9 hours";
         grouping?: "second" | "minute" | "hour" | "day" | "week" | "month" | "year";
         rollingAverage?: number;
+        date?: string;
         from?: string;
         to?: string;
       };